@@ -0,0 +1,119 @@
+// Package v1alpha1 contains the types of the image policies, which declare
+// the authorities images are verified against.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "cosignwebhook.eumel8.github.io"
+	Version = "v1alpha1"
+)
+
+var (
+	// ClusterImagePolicyResource is the cluster-scoped ClusterImagePolicy resource
+	ClusterImagePolicyResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "clusterimagepolicies"}
+	// ImagePolicyResource is the namespaced ImagePolicy resource
+	ImagePolicyResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "imagepolicies"}
+)
+
+// ClusterImagePolicy maps image patterns to the authorities their signatures are verified against
+type ClusterImagePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImagePolicySpec `json:"spec"`
+}
+
+// ImagePolicy maps image patterns to the authorities for the pods of its namespace.
+// Secrets referenced by its keys are always read from the namespace of the policy.
+type ImagePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImagePolicySpec `json:"spec"`
+}
+
+// ImagePolicySpec holds the image patterns and the authorities of a policy
+type ImagePolicySpec struct {
+	// Images are the patterns of the images the policy applies to
+	Images []ImagePattern `json:"images"`
+	// Authorities are the keys and keyless identities the images are verified against.
+	// The signature must be verified by at least Threshold of them.
+	Authorities []Authority `json:"authorities"`
+	// Threshold is the number of authorities required to verify the signatures:
+	// any (the default), all or a number. Each key and each keyless identity counts once.
+	Threshold string `json:"threshold,omitempty"`
+	// Annotations are required on the signatures, like `cosign verify -a key=value`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Attestations are required in addition to the signature, each signed by one of the authorities
+	Attestations []Attestation `json:"attestations,omitempty"`
+	// Policy is evaluated once the signatures and attestations are verified, against the annotations
+	// of the signatures, the attestations, the pod metadata and the namespace labels
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// ImagePattern matches images by a glob. A single '*' matches within a path segment,
+// '**' matches across segments, e.g. ghcr.io/myorg/**
+type ImagePattern struct {
+	Glob string `json:"glob"`
+}
+
+// Authority is either a public key or a keyless identity
+type Authority struct {
+	// Name of the authority, used in log messages
+	Name    string   `json:"name,omitempty"`
+	Key     *Key     `json:"key,omitempty"`
+	Keyless *Keyless `json:"keyless,omitempty"`
+}
+
+// Key is a PEM encoded public key, either inlined or referenced in a Secret, or a KMS key reference.
+// Several concatenated PEM blocks are separate authorities.
+type Key struct {
+	Data      string        `json:"data,omitempty"`
+	SecretRef *SecretKeyRef `json:"secretRef,omitempty"`
+	// KMS references a key of a KMS, e.g. awskms://, gcpkms://, azurekms:// or hashivault://
+	KMS string `json:"kms,omitempty"`
+	// Algorithm is the signature algorithm, e.g. rsa-pss-sha256. It's derived from the key if empty.
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// SecretKeyRef references a key of a Secret
+type SecretKeyRef struct {
+	Name string `json:"name"`
+	// Namespace of the Secret, ignored for an ImagePolicy
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+// Keyless holds the identities of keyless signatures. Each identity is a separate authority.
+type Keyless struct {
+	Identities []Identity `json:"identities"`
+}
+
+// Attestation requires an in-toto attestation of the predicate type
+type Attestation struct {
+	// Name of the attestation, used in log messages and denials
+	Name string `json:"name,omitempty"`
+	// PredicateType is the in-toto predicate type, or a cosign shorthand like slsaprovenance, cyclonedx or spdxjson
+	PredicateType string `json:"predicateType"`
+	// Policy is evaluated against the in-toto statement, at least one attestation must satisfy it
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// Policy is a CUE or Rego policy
+type Policy struct {
+	// Type is either cue or rego
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// Identity is the expected subject and OIDC issuer of a Fulcio certificate
+type Identity struct {
+	Subject       string `json:"subject,omitempty"`
+	SubjectRegExp string `json:"subjectRegExp,omitempty"`
+	Issuer        string `json:"issuer,omitempty"`
+	IssuerRegExp  string `json:"issuerRegExp,omitempty"`
+}
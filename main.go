@@ -16,6 +16,7 @@ import (
 	"github.com/eumel8/cosignwebhook/webhook"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const (
@@ -32,6 +33,31 @@ func main() {
 	flag.StringVar(&tlscert, "tlsCertFile", "/etc/certs/tls.crt", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&tlskey, "tlsKeyFile", "/etc/certs/tls.key", "File containing the x509 private key to --tlsCertFile.")
 	logLevel := flag.String("logLevel", "info", "loglevel of app, e.g info, debug, warn, error, fatal")
+	fulcioRoot := flag.String("fulcioRootFile", "", "File containing the Fulcio certificate chain for keyless verification. Keyless verification is disabled if empty.")
+	rekorPubKey := flag.String("rekorPubKeyFile", "", "File containing the Rekor public key for offline transparency log verification.")
+	imagePolicies := flag.Bool("imagePolicies", false, "Watch the ClusterImagePolicies and ImagePolicies and consult them before the container's env vars.")
+	requireTlog := flag.Bool("requireTlog", false, "Require signatures to be logged in the transparency log. May be overridden per namespace with the cosignwebhook/tlog label.")
+	enforce := flag.Bool("enforce", false, "Deny pods with containers no public key, keyless identity or image policy was found for. May be overridden per namespace with the cosignwebhook/enforce label.")
+	warn := flag.Bool("warn", false, "Admit pods failing verification with a warning instead of denying them. May be overridden per namespace with the cosignwebhook/warn label.")
+	cacheSize := flag.Int("cacheSize", 1000, "Maximum number of cached verification results. Caching is disabled if 0.")
+	cacheTTL := flag.Duration("cacheTTL", 5*time.Minute, "Time successful verifications are cached.")
+	cacheNegativeTTL := flag.Duration("cacheNegativeTTL", 30*time.Second, "Time failed verifications are cached.")
+	workers := flag.Int("verifyWorkers", 4, "Maximum number of containers of a pod verified concurrently.")
+	secretCache := flag.Bool("secretCache", true, "Watch the Secrets with keys and settings instead of getting them for every admission.")
+	secretLabelSelector := flag.String("secretLabelSelector", "app.kubernetes.io/part-of=cosignwebhook", "Only cache the Secrets matching the label selector, others are got from the API server. Required with -secretCache.")
+	decisionLog := flag.String("decisionLog", "", "File of the JSON decision log with a record of every admission, stdout if empty. The text log is written to stderr then.")
+	decisionLogMaxSize := flag.Uint("decisionLogMaxSize", 100, "Size in megabytes the decision log file is rotated at.")
+	decisionLogBackups := flag.Uint("decisionLogBackups", 5, "Number of rotated decision log files kept.")
+	metricsNamespaces := flag.Int("metricsNamespaces", 100, "Maximum number of namespaces recorded in the metrics, later ones are recorded as other.")
+	metricsRegistries := flag.Int("metricsRegistries", 20, "Maximum number of registries recorded in the metrics, later ones are recorded as other.")
+	tracingEndpoint := flag.String("tracingEndpoint", "", "OTLP/HTTP collector endpoint the spans of the admissions are exported to, e.g. http://otel-collector:4318. Tracing is disabled if empty.")
+	tracingSampleRatio := flag.Float64("tracingSampleRatio", 1, "Ratio of the admissions traced, unless the API server sent a sampled trace context.")
+	keychainCache := flag.Bool("keychainCache", true, "Reuse the registry keychains of pods with the same service account and pull secrets, until they change.")
+	selfManagedCerts := flag.Bool("selfManagedCerts", false, "Generate the CA and serving certificate instead of reading --tlsCertFile and --tlsKeyFile. They're stored in --certSecret, replicas coordinate with a Lease of the same name.")
+	certSecret := flag.String("certSecret", "cosignwebhook", "Secret of the self-managed certificates in the namespace of the webhook (POD_NAMESPACE).")
+	webhookService := flag.String("webhookService", "cosignwebhook", "Service of the webhook the self-managed certificate is issued for.")
+	webhookConfig := flag.String("webhookConfig", "cosignwebhook", "ValidatingWebhookConfiguration and MutatingWebhookConfiguration the self-managed CA is injected into.")
+	certValidity := flag.Duration("certValidity", 90*24*time.Hour, "Validity of the self-managed serving certificate, the CA is valid ten times as long.")
 	flag.Parse()
 
 	// set log level
@@ -53,17 +79,74 @@ func main() {
 	}
 
 	log.GetFormatter().(*log.TextFormatter).SetTemplate(logTemplate)
+	// the decision log on stdout isn't interleaved with the text log
+	if *decisionLog == "" {
+		log.Std().Output = os.Stderr
+	}
+
+	// without a selector, the data of all Secrets of the cluster would be kept in memory
+	if *secretCache && *secretLabelSelector == "" {
+		log.Error("The secret cache requires -secretLabelSelector, disable it with -secretCache=false")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var certs webhook.CertificateSource
+	if *selfManagedCerts {
+		// the webhook is unready until the leader stored the certificate
+		smc, err := webhook.NewSelfManagedCerts(webhook.SelfManagedCertsConfig{
+			Namespace:     os.Getenv("POD_NAMESPACE"),
+			Service:       *webhookService,
+			Secret:        *certSecret,
+			WebhookConfig: *webhookConfig,
+			Validity:      *certValidity,
+			Identity:      os.Getenv("HOSTNAME"),
+		})
+		if err == nil {
+			err = smc.Run(ctx)
+		}
+		if err != nil {
+			log.Errorf("Can't manage certificates: %v", err)
+			cancel()
+			os.Exit(1)
+		}
+		certs = smc
+	} else {
+		// the webhook doesn't start without a valid certificate, rotated certificates are reloaded
+		cw, err := webhook.NewCertWatcher(tlscert, tlskey)
+		if err == nil {
+			err = cw.Watch(ctx)
+		}
+		if err != nil {
+			log.Errorf("Can't load certificate: %v", err)
+			cancel()
+			os.Exit(1)
+		}
+		certs = cw
+	}
 
-	certs, err := tls.LoadX509KeyPair(tlscert, tlskey)
+	decisions, err := webhook.OpenDecisionLog(*decisionLog, *decisionLogMaxSize, *decisionLogBackups)
 	if err != nil {
-		log.Errorf("failed to load key pair: %v", err)
+		log.Errorf("Can't open decision log: %v", err)
+		cancel()
+		os.Exit(1)
+	}
+
+	var tracerProvider *sdktrace.TracerProvider
+	if *tracingEndpoint != "" {
+		tracerProvider, err = webhook.NewTracerProvider(ctx, *tracingEndpoint, *tracingSampleRatio)
+		if err != nil {
+			log.Errorf("Can't export traces: %v", err)
+			cancel()
+			os.Exit(1)
+		}
 	}
 
 	server := &http.Server{
 		Addr: fmt.Sprintf(":%v", port),
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{certs},
-			MinVersion:   tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
 		},
 		ReadHeaderTimeout: timeout,
 	}
@@ -74,13 +157,38 @@ func main() {
 	}
 
 	// define http server and server handler
-	cs := webhook.NewCosignServerHandler()
+	cfg := webhook.Config{
+		FulcioRootFile:      *fulcioRoot,
+		RekorPubKeyFile:     *rekorPubKey,
+		RequireTlog:         *requireTlog,
+		Enforce:             *enforce,
+		Warn:                *warn,
+		CacheSize:           *cacheSize,
+		CacheTTL:            *cacheTTL,
+		CacheNegativeTTL:    *cacheNegativeTTL,
+		Workers:             *workers,
+		ImagePolicies:       *imagePolicies,
+		Certs:               certs,
+		SecretCache:         *secretCache,
+		SecretLabelSelector: *secretLabelSelector,
+		KeychainCache:       *keychainCache,
+		DecisionLog:         decisions,
+		MetricsNamespaces:   *metricsNamespaces,
+		MetricsRegistries:   *metricsRegistries,
+	}
+	// a nil provider must not be passed as interface
+	if tracerProvider != nil {
+		cfg.TracerProvider = tracerProvider
+	}
+	cs := webhook.NewCosignServerHandler(cfg)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/validate", cs.Serve)
+	mux.HandleFunc("/mutate", cs.Serve)
 	server.Handler = mux
 
 	mmux := http.NewServeMux()
 	mmux.HandleFunc("/healthz", cs.Healthz)
+	mmux.HandleFunc("/readyz", cs.Readyz)
 	mmux.Handle("/metrics", promhttp.Handler())
 	mserver.Handler = mmux
 
@@ -105,4 +213,13 @@ func main() {
 	log.Info("Got shutdown signal, shutting down webhook server gracefully...")
 	_ = server.Shutdown(context.Background())
 	_ = mserver.Shutdown(context.Background())
+	if tracerProvider != nil {
+		// flush the remaining spans
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Failed to flush traces: %v", err)
+		}
+		shutdownCancel()
+	}
+	cancel()
 }
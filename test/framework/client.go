@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +21,8 @@ type Framework struct {
 	k8s *kubernetes.Clientset
 	t   *testing.T
 	err error
+	// denied holds the deployments denied by the webhook on creation
+	denied map[string]error
 }
 
 // New creates a new Framework
@@ -34,8 +37,9 @@ func New(t *testing.T) (*Framework, error) {
 	}
 
 	return &Framework{
-		k8s: k8s,
-		t:   t,
+		k8s:    k8s,
+		t:      t,
+		denied: map[string]error{},
 	}, nil
 }
 
@@ -190,6 +194,12 @@ func (f *Framework) CreateDeployment(d appsv1.Deployment) {
 
 	f.t.Logf("creating deployment %s", d.Name)
 	_, err := f.k8s.AppsV1().Deployments(d.Namespace).Create(context.Background(), &d, metav1.CreateOptions{})
+	if err != nil && strings.Contains(err.Error(), "admission webhook") {
+		// workloads are verified on submission, failing deployments are denied right away
+		f.t.Logf("deployment %s denied: %v", d.Name, err)
+		f.denied[d.Name] = err
+		return
+	}
 	if err != nil {
 		f.err = err
 		return
@@ -217,6 +227,10 @@ func (f *Framework) WaitForDeployment(d appsv1.Deployment) {
 	if f.err != nil {
 		return
 	}
+	if err, ok := f.denied[d.Name]; ok {
+		f.err = err
+		return
+	}
 
 	f.t.Logf("waiting for deployment %s to be ready", d.Name)
 	// wait until the deployment is ready
@@ -282,8 +296,18 @@ func (f *Framework) waitForReplicaSetCreation(d appsv1.Deployment) string {
 	}
 }
 
-// AssertDeploymentFailed asserts that the deployment cannot start.
+// DeploymentDenied returns whether the webhook denied the creation of the deployment.
+func (f *Framework) DeploymentDenied(d appsv1.Deployment) bool {
+	_, ok := f.denied[d.Name]
+	return ok
+}
+
+// AssertDeploymentFailed asserts that the deployment cannot start,
+// either because it was denied or because its pods are denied.
 func (f *Framework) AssertDeploymentFailed(d appsv1.Deployment) {
+	if f.DeploymentDenied(d) {
+		return
+	}
 	_, ok := f.WaitForReplicaSetFailedCreateEvent(d)
 	if !ok && f.err == nil {
 		f.err = fmt.Errorf("deployment %s did not emit a FailedCreate event", d.Name)
@@ -1078,6 +1078,10 @@ func testOneContainerMalformedDockerconfigjson(fw *framework.Framework, _ framew
 	return func(t *testing.T) {
 		fw.CreateSecret(secret)
 		fw.CreateDeployment(depl)
+		if fw.DeploymentDenied(depl) {
+			fw.Cleanup()
+			return
+		}
 		event, ok := fw.WaitForReplicaSetFailedCreateEvent(depl)
 		if !ok {
 			fw.Cleanup()
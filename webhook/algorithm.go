@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CosignKeyAlgorithmEnvVar is the signature algorithm of the container's public keys, derived from the key if not set
+const CosignKeyAlgorithmEnvVar = "COSIGN_KEY_ALGORITHM"
+
+const (
+	schemeECDSA       = "ecdsa"
+	schemeRSAPKCS1v15 = "rsa-pkcs1v15"
+	schemeRSAPSS      = "rsa-pss"
+	schemeEd25519     = "ed25519"
+)
+
+// signatureAlgorithm is the signature scheme and the hash function signatures are verified with
+type signatureAlgorithm struct {
+	scheme string
+	hash   crypto.Hash
+}
+
+// signatureAlgorithms are the algorithms which can be configured explicitly
+var signatureAlgorithms = map[string]signatureAlgorithm{
+	"ecdsa-sha256":        {schemeECDSA, crypto.SHA256},
+	"ecdsa-sha384":        {schemeECDSA, crypto.SHA384},
+	"ecdsa-sha512":        {schemeECDSA, crypto.SHA512},
+	"rsa-pkcs1v15-sha256": {schemeRSAPKCS1v15, crypto.SHA256},
+	"rsa-pkcs1v15-sha384": {schemeRSAPKCS1v15, crypto.SHA384},
+	"rsa-pkcs1v15-sha512": {schemeRSAPKCS1v15, crypto.SHA512},
+	"rsa-pss-sha256":      {schemeRSAPSS, crypto.SHA256},
+	"rsa-pss-sha384":      {schemeRSAPSS, crypto.SHA384},
+	"rsa-pss-sha512":      {schemeRSAPSS, crypto.SHA512},
+	"ed25519":             {schemeEd25519, 0},
+}
+
+// supportedAlgorithms lists the names of the algorithms for error messages
+func supportedAlgorithms() string {
+	names := make([]string, 0, len(signatureAlgorithms))
+	for n := range signatureAlgorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// keyAlgorithm returns the configured algorithm, or derives it from the key if none is configured:
+// ECDSA uses the hash matching the curve, RSA uses PKCS#1 v1.5 with SHA-256.
+func keyAlgorithm(publicKey crypto.PublicKey, configured string) (signatureAlgorithm, error) {
+	var derived signatureAlgorithm
+	switch pub := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			derived = signatureAlgorithm{schemeECDSA, crypto.SHA256}
+		case elliptic.P384():
+			derived = signatureAlgorithm{schemeECDSA, crypto.SHA384}
+		case elliptic.P521():
+			derived = signatureAlgorithm{schemeECDSA, crypto.SHA512}
+		default:
+			return signatureAlgorithm{}, fmt.Errorf("unsupported ECDSA curve %s, supported are P-256, P-384 and P-521", pub.Curve.Params().Name)
+		}
+	case *rsa.PublicKey:
+		derived = signatureAlgorithm{schemeRSAPKCS1v15, crypto.SHA256}
+	case ed25519.PublicKey:
+		derived = signatureAlgorithm{schemeEd25519, 0}
+	default:
+		return signatureAlgorithm{}, fmt.Errorf("unsupported public key type %T, supported are ECDSA, RSA and Ed25519", publicKey)
+	}
+
+	if configured == "" {
+		return derived, nil
+	}
+	alg, ok := signatureAlgorithms[strings.ToLower(configured)]
+	if !ok {
+		return signatureAlgorithm{}, fmt.Errorf("unsupported signature algorithm %q, supported are %s", configured, supportedAlgorithms())
+	}
+	return alg, nil
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	log "github.com/gookit/slog"
+
+	"github.com/sigstore/cosign/v3/pkg/oci"
+	"github.com/sigstore/cosign/v3/pkg/types"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CosignAnnotationsEnvVar lists the annotations the signatures of the container must carry,
+// comma-separated key=value pairs like `cosign verify -a`
+const CosignAnnotationsEnvVar = "COSIGN_ANNOTATIONS"
+
+// parseAnnotations parses comma-separated key=value pairs, it returns nil if s is empty
+func parseAnnotations(s string) (map[string]any, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	annotations := map[string]any{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid annotation %q, must be key=value", kv)
+		}
+		annotations[k] = v
+	}
+	return annotations, nil
+}
+
+// getAnnotationsFor returns the annotations required on the container's signatures.
+// They're read from the container's environment or the default secret of the namespace.
+func (csh *CosignServerHandler) getAnnotationsFor(c *corev1.Container, ns string) (map[string]any, error) {
+	return parseAnnotations(csh.getSettingFor(c, ns, CosignAnnotationsEnvVar))
+}
+
+// checkAnnotations checks the annotations of a verified signature contain the required ones.
+// The error names all missing and mismatching annotations.
+func checkAnnotations(required, have map[string]any) error {
+	var mismatches []string
+	for _, k := range slices.Sorted(maps.Keys(required)) {
+		v, ok := have[k]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s missing, expected %q", k, fmt.Sprint(required[k])))
+		case v != required[k]:
+			mismatches = append(mismatches, fmt.Sprintf("%s is %q, expected %q", k, fmt.Sprint(v), fmt.Sprint(required[k])))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("signature annotations don't match: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// checkSignatureAnnotations checks the verified signatures carry the required annotations, each on its own
+// like `cosign verify -a`. It returns the annotations of the matching signatures, the error names the missing
+// and mismatching annotations of the first signature.
+func checkSignatureAnnotations(required map[string]any, sigs []map[string]any) ([]map[string]any, error) {
+	matching := make([]map[string]any, 0, len(sigs))
+	var firstErr error
+	for _, have := range sigs {
+		if err := checkAnnotations(required, have); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		matching = append(matching, have)
+	}
+	if len(matching) == 0 {
+		if firstErr == nil {
+			return nil, checkAnnotations(required, nil)
+		}
+		return nil, firstErr
+	}
+	return matching, nil
+}
+
+// bundleAnnotations returns the annotations of each verified bundle signature.
+// They're stored on the subject of the in-toto statement of the cosign sign predicate.
+func bundleAnnotations(sigs []oci.Signature) []map[string]any {
+	var annotations []map[string]any
+	for _, sig := range sigs {
+		p, err := sig.Payload()
+		if err != nil {
+			log.Debugf("Skipping bundle without payload: %v", err)
+			continue
+		}
+		var envelope struct {
+			Payload []byte `json:"payload"`
+		}
+		if err := json.Unmarshal(p, &envelope); err != nil {
+			log.Debugf("Skipping malformed bundle envelope: %v", err)
+			continue
+		}
+		var statement struct {
+			PredicateType string `json:"predicateType"`
+			Subject       []struct {
+				Annotations map[string]any `json:"annotations"`
+			} `json:"subject"`
+		}
+		if err := json.Unmarshal(envelope.Payload, &statement); err != nil {
+			log.Debugf("Skipping malformed bundle statement: %v", err)
+			continue
+		}
+		if statement.PredicateType != types.CosignSignPredicateType {
+			continue
+		}
+		// the subjects are signed together
+		signed := map[string]any{}
+		for _, subject := range statement.Subject {
+			maps.Copy(signed, subject.Annotations)
+		}
+		annotations = append(annotations, signed)
+	}
+	return annotations
+}
+
+// legacyAnnotations returns the annotations of each verified legacy signature.
+// They're stored in the optional section of the simple signing payload.
+func legacyAnnotations(sigs []oci.Signature) []map[string]any {
+	var annotations []map[string]any
+	for _, sig := range sigs {
+		p, err := sig.Payload()
+		if err != nil {
+			log.Debugf("Skipping signature without payload: %v", err)
+			continue
+		}
+		var ss payload.SimpleContainerImage
+		if err := json.Unmarshal(p, &ss); err != nil {
+			log.Debugf("Skipping malformed signature payload: %v", err)
+			continue
+		}
+		signed := ss.Optional
+		if signed == nil {
+			signed = map[string]any{}
+		}
+		annotations = append(annotations, signed)
+	}
+	return annotations
+}
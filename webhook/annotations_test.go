@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sigstore/cosign/v3/pkg/oci"
+	"github.com/sigstore/cosign/v3/pkg/oci/static"
+	"github.com/sigstore/cosign/v3/pkg/types"
+)
+
+func Test_parseAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]any
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "single", value: "env=prod", want: map[string]any{"env": "prod"}},
+		{name: "multiple", value: "env=prod, team=shop", want: map[string]any{"env": "prod", "team": "shop"}},
+		{name: "empty value", value: "env=", want: map[string]any{"env": ""}},
+		{name: "value with equals", value: "query=a=b", want: map[string]any{"query": "a=b"}},
+		{name: "missing value", value: "env", wantErr: true},
+		{name: "missing key", value: "=prod", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAnnotations(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAnnotations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAnnotations() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		required map[string]any
+		have     map[string]any
+		wantErr  string
+	}{
+		{name: "none required", have: map[string]any{"env": "dev"}},
+		{name: "match", required: map[string]any{"env": "prod"}, have: map[string]any{"env": "prod", "team": "shop"}},
+		{
+			name:     "mismatch",
+			required: map[string]any{"env": "prod"},
+			have:     map[string]any{"env": "dev"},
+			wantErr:  `signature annotations don't match: env is "dev", expected "prod"`,
+		},
+		{
+			name:     "missing",
+			required: map[string]any{"env": "prod", "team": "shop"},
+			have:     map[string]any{"env": "prod"},
+			wantErr:  `signature annotations don't match: team missing, expected "shop"`,
+		},
+		{
+			name:     "all mismatches",
+			required: map[string]any{"env": "prod", "team": "shop"},
+			wantErr:  `signature annotations don't match: env missing, expected "prod", team missing, expected "shop"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAnnotations(tt.required, tt.have)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkAnnotations() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkAnnotations() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkSignatureAnnotations(t *testing.T) {
+	required := map[string]any{"env": "prod", "team": "shop"}
+	tests := []struct {
+		name    string
+		sigs    []map[string]any
+		want    []map[string]any
+		wantErr string
+	}{
+		{
+			name: "single signature",
+			sigs: []map[string]any{{"env": "prod", "team": "shop", "commit": "abc123"}},
+			want: []map[string]any{{"env": "prod", "team": "shop", "commit": "abc123"}},
+		},
+		{
+			name: "one of the signatures",
+			sigs: []map[string]any{{"env": "dev"}, {"env": "prod", "team": "shop"}},
+			want: []map[string]any{{"env": "prod", "team": "shop"}},
+		},
+		{
+			name:    "annotations of different signatures aren't merged",
+			sigs:    []map[string]any{{"env": "prod"}, {"team": "shop"}},
+			wantErr: `signature annotations don't match: team missing, expected "shop"`,
+		},
+		{
+			name:    "no signatures",
+			wantErr: `signature annotations don't match: env missing, expected "prod", team missing, expected "shop"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkSignatureAnnotations(required, tt.sigs)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("checkSignatureAnnotations() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkSignatureAnnotations() unexpected error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkSignatureAnnotations() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_legacyAnnotations(t *testing.T) {
+	sigs := []oci.Signature{
+		testLegacySignature(t, map[string]any{"env": "prod", "team": "shop"}),
+		testLegacySignature(t, nil),
+		testLegacySignature(t, map[string]any{"commit": "abc123"}),
+	}
+	want := []map[string]any{{"env": "prod", "team": "shop"}, {}, {"commit": "abc123"}}
+	if got := legacyAnnotations(sigs); !reflect.DeepEqual(got, want) {
+		t.Errorf("legacyAnnotations() got = %v, want %v", got, want)
+	}
+}
+
+func Test_bundleAnnotations(t *testing.T) {
+	sigs := []oci.Signature{
+		testBundleSignature(t, map[string]any{"env": "prod"}),
+		testAttestation(t, "https://slsa.dev/provenance/v0.2", map[string]any{}),
+	}
+	want := []map[string]any{{"env": "prod"}}
+	if got := bundleAnnotations(sigs); !reflect.DeepEqual(got, want) {
+		t.Errorf("bundleAnnotations() got = %v, want %v", got, want)
+	}
+}
+
+// testLegacySignature returns a signature with a simple signing payload carrying the annotations
+func testLegacySignature(t testing.TB, annotations map[string]any) oci.Signature {
+	payload, err := json.Marshal(map[string]any{
+		"critical": map[string]any{
+			"identity": map[string]any{"docker-reference": "registry.example.com/app"},
+			"image":    map[string]any{"docker-manifest-digest": "sha256:0123"},
+			"type":     "cosign container image signature",
+		},
+		"optional": annotations,
+	})
+	if err != nil {
+		t.Fatalf("failed encoding payload: %v", err)
+	}
+	sig, err := static.NewSignature(payload, "")
+	if err != nil {
+		t.Fatalf("failed creating signature: %v", err)
+	}
+	return sig
+}
+
+// testBundleSignature returns a DSSE envelope with the cosign sign statement, its subject carrying the annotations
+func testBundleSignature(t testing.TB, annotations map[string]any) oci.Signature {
+	statement, err := json.Marshal(map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"predicateType": types.CosignSignPredicateType,
+		"subject": []any{map[string]any{
+			"digest":      map[string]any{"sha256": "0123"},
+			"annotations": annotations,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed encoding statement: %v", err)
+	}
+	envelope, err := json.Marshal(map[string]any{
+		"payloadType": "application/vnd.in-toto+json",
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+	})
+	if err != nil {
+		t.Fatalf("failed encoding envelope: %v", err)
+	}
+	sig, err := static.NewAttestation(envelope)
+	if err != nil {
+		t.Fatalf("failed creating signature: %v", err)
+	}
+	return sig
+}
@@ -0,0 +1,159 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	log "github.com/gookit/slog"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/cosign/v3/pkg/oci"
+	ociremote "github.com/sigstore/cosign/v3/pkg/oci/remote"
+	"github.com/sigstore/cosign/v3/pkg/policy"
+)
+
+// validateAttestation makes sure the required attestation declares a predicate type and a supported policy
+func validateAttestation(a *v1alpha1.Attestation) error {
+	if a.PredicateType == "" {
+		return fmt.Errorf("attestation %q has no predicate type", a.Name)
+	}
+	if a.Policy == nil {
+		return nil
+	}
+	return validatePolicy(fmt.Sprintf("attestation %q", a.Name), a.Policy)
+}
+
+// attestationName returns the name of the attestation, or its predicate type if it has none
+func attestationName(a *v1alpha1.Attestation) string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.PredicateType
+}
+
+// verifyAttestations verifies the attestations required by the policy of the group.
+// Each attestation must be signed by one of the authorities of the group.
+// It returns the in-toto statements of the required attestations by attestation name.
+func (csh *CosignServerHandler) verifyAttestations(ctx context.Context, digest name.Digest, g *authorityGroup, repo string, remoteOpts []ociremote.Option) (map[string]any, error) {
+	if len(g.attestations) == 0 {
+		return nil, nil
+	}
+	errs := make([]error, 0, len(g.auths))
+	for _, auth := range g.auths {
+		key := cacheKey(digest, auth, repo) + "|attestations|" + attestationsKey(g.attestations)
+		r, cached := csh.cache.get(key)
+		if !cached {
+			r.attestations, r.err = csh.verifyAttestationsBy(ctx, digest, auth, g.attestations, remoteOpts)
+			csh.cache.add(key, r)
+		}
+		if r.err == nil {
+			return r.attestations, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// attestationsKey identifies the required attestations and their policies in the cache
+func attestationsKey(atts []v1alpha1.Attestation) string {
+	b, _ := json.Marshal(atts)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// verifyAttestationsBy verifies the attestations of the image signed by the authority
+// and checks all required attestations are among them.
+// It returns the in-toto statements of the required attestations by attestation name.
+func (csh *CosignServerHandler) verifyAttestationsBy(ctx context.Context, digest name.Digest, auth *authority, required []v1alpha1.Attestation, remoteOpts []ociremote.Option) (map[string]any, error) {
+	co, err := csh.buildCheckOpts(ctx, digest.String(), auth, remoteOpts)
+	if err != nil {
+		return nil, withReason(reasonConfig, err)
+	}
+	verified, err := csh.getVerifiedAttestations(ctx, digest, co)
+	if err != nil {
+		return nil, err
+	}
+	statements := make(map[string]any, len(required))
+	for i := range required {
+		payload, err := checkAttestation(ctx, &required[i], verified)
+		if err != nil {
+			return nil, err
+		}
+		var statement any
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			return nil, fmt.Errorf("could not decode attestation %s: %w", attestationName(&required[i]), err)
+		}
+		statements[attestationName(&required[i])] = statement
+	}
+	return statements, nil
+}
+
+// getVerifiedAttestations returns the attestations of the image verified with the check options,
+// both in the sigstore bundle format and as legacy attestation tags.
+func (*CosignServerHandler) getVerifiedAttestations(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) ([]oci.Signature, error) {
+	// the subject of the in-toto statement must be the verified image
+	co.ClaimVerifier = cosign.IntotoSubjectClaimVerifier
+
+	bundleOpts := *co
+	bundleOpts.NewBundleFormat = true
+	bundled, _, bundleErr := cosign.VerifyImageAttestations(ctx, refImage, &bundleOpts)
+	if bundleErr != nil {
+		log.Debugf("No bundled attestations verified for image %q: %v", refImage.String(), bundleErr)
+	}
+
+	legacyOpts := *co
+	legacyOpts.NewBundleFormat = false
+	legacy, _, legacyErr := cosign.VerifyImageAttestations(ctx, refImage, &legacyOpts)
+	if legacyErr != nil {
+		log.Debugf("No legacy attestations verified for image %q: %v", refImage.String(), legacyErr)
+	}
+
+	if bundleErr != nil && legacyErr != nil {
+		log.Errorf("Error verifying attestations of image %q: %v", refImage.String(), legacyErr)
+		err := legacyErr
+		if transientError(bundleErr) {
+			err = bundleErr
+		}
+		return nil, fmt.Errorf("no attestations of image %q could be verified: %w", refImage.String(), err)
+	}
+	return append(bundled, legacy...), nil
+}
+
+// checkAttestation checks an attestation of the required predicate type is among the verified ones.
+// If the attestation declares a policy, at least one of them must satisfy it.
+// It returns the in-toto statement of the matching attestation.
+func checkAttestation(ctx context.Context, required *v1alpha1.Attestation, verified []oci.Signature) ([]byte, error) {
+	n := attestationName(required)
+	var found []string
+	var policyErrs []error
+	for _, att := range verified {
+		payload, predicateType, err := policy.AttestationToPayloadJSON(ctx, required.PredicateType, att)
+		if err != nil {
+			log.Debugf("Skipping attestation: %v", err)
+			continue
+		}
+		if payload == nil {
+			found = append(found, predicateType)
+			continue
+		}
+		if required.Policy == nil {
+			return payload, nil
+		}
+		_, err = policy.EvaluatePolicyAgainstJSON(ctx, n, required.Policy.Type, required.Policy.Data, payload)
+		if err == nil {
+			log.Debugf("Attestation %s satisfies its policy", n)
+			return payload, nil
+		}
+		policyErrs = append(policyErrs, err)
+	}
+	if len(policyErrs) > 0 {
+		return nil, fmt.Errorf("attestation %s doesn't satisfy its policy: %w", n, errors.Join(policyErrs...))
+	}
+	return nil, fmt.Errorf("attestation %s missing, found predicate types %v", n, found)
+}
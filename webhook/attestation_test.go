@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/sigstore/cosign/v3/pkg/oci"
+	"github.com/sigstore/cosign/v3/pkg/oci/static"
+)
+
+func Test_validateAttestation(t *testing.T) {
+	tests := []struct {
+		name        string
+		attestation v1alpha1.Attestation
+		wantErr     bool
+	}{
+		{
+			name:        "predicate type only",
+			attestation: v1alpha1.Attestation{PredicateType: "slsaprovenance"},
+		},
+		{
+			name: "cue policy",
+			attestation: v1alpha1.Attestation{
+				PredicateType: "slsaprovenance",
+				Policy:        &v1alpha1.Policy{Type: "cue", Data: `predicateType: "https://slsa.dev/provenance/v0.2"`},
+			},
+		},
+		{
+			name:        "missing predicate type",
+			attestation: v1alpha1.Attestation{Name: "sbom"},
+			wantErr:     true,
+		},
+		{
+			name: "unsupported policy type",
+			attestation: v1alpha1.Attestation{
+				PredicateType: "cyclonedx",
+				Policy:        &v1alpha1.Policy{Type: "cel", Data: "true"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty policy",
+			attestation: v1alpha1.Attestation{
+				PredicateType: "cyclonedx",
+				Policy:        &v1alpha1.Policy{Type: "rego"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAttestation(&tt.attestation); (err != nil) != tt.wantErr {
+				t.Errorf("validateAttestation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_checkAttestation(t *testing.T) {
+	provenance := testAttestation(t, "https://slsa.dev/provenance/v0.2", map[string]any{
+		"builder": map[string]any{"id": "https://github.com/myorg/builder"},
+	})
+	sbom := testAttestation(t, "https://cyclonedx.org/bom", map[string]any{"bomFormat": "CycloneDX"})
+
+	tests := []struct {
+		name     string
+		required v1alpha1.Attestation
+		verified []oci.Signature
+		wantErr  bool
+	}{
+		{
+			name:     "attestation present",
+			required: v1alpha1.Attestation{PredicateType: "slsaprovenance"},
+			verified: []oci.Signature{sbom, provenance},
+		},
+		{
+			name:     "attestation missing",
+			required: v1alpha1.Attestation{PredicateType: "slsaprovenance"},
+			verified: []oci.Signature{sbom},
+			wantErr:  true,
+		},
+		{
+			name: "cue policy satisfied",
+			required: v1alpha1.Attestation{
+				PredicateType: "slsaprovenance",
+				Policy:        &v1alpha1.Policy{Type: "cue", Data: `predicate: builder: id: "https://github.com/myorg/builder"`},
+			},
+			verified: []oci.Signature{provenance},
+		},
+		{
+			name: "cue policy violated",
+			required: v1alpha1.Attestation{
+				PredicateType: "slsaprovenance",
+				Policy:        &v1alpha1.Policy{Type: "cue", Data: `predicate: builder: id: "https://github.com/other/builder"`},
+			},
+			verified: []oci.Signature{provenance},
+			wantErr:  true,
+		},
+		{
+			name:     "no verified attestations",
+			required: v1alpha1.Attestation{PredicateType: "cyclonedx"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := checkAttestation(t.Context(), &tt.required, tt.verified); (err != nil) != tt.wantErr {
+				t.Errorf("checkAttestation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testAttestation returns a DSSE envelope with an in-toto statement of the predicate type
+func testAttestation(t testing.TB, predicateType string, predicate any) oci.Signature {
+	statement, err := json.Marshal(map[string]any{
+		"_type":         "https://in-toto.io/Statement/v0.1",
+		"predicateType": predicateType,
+		"subject":       []any{},
+		"predicate":     predicate,
+	})
+	if err != nil {
+		t.Fatalf("failed encoding statement: %v", err)
+	}
+	envelope, err := json.Marshal(map[string]any{
+		"payloadType": "application/vnd.in-toto+json",
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+	})
+	if err != nil {
+		t.Fatalf("failed encoding envelope: %v", err)
+	}
+	sig, err := static.NewAttestation(envelope)
+	if err != nil {
+		t.Fatalf("failed creating attestation: %v", err)
+	}
+	return sig
+}
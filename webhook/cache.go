@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/gookit/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cosign_cache_hits_total",
+		Help: "The number of verification results served from the cache",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cosign_cache_misses_total",
+		Help: "The number of verifications not found in the cache",
+	})
+)
+
+// verificationResult is a cached verification outcome, err is nil if the signature was verified
+type verificationResult struct {
+	err error
+	// format of the verified signature, bundle or legacy
+	format string
+	// keyFingerprint is the fingerprint of the public key the signature was verified with, empty for keyless signatures
+	keyFingerprint string
+	// signers are the certificate identities of the verified keyless signatures
+	signers []string
+	// annotations of each verified signature carrying the required annotations
+	annotations []map[string]any
+	// attestations are the in-toto statements of the verified attestations by attestation name
+	attestations map[string]any
+}
+
+// verificationCache caches verification outcomes, so the replicas of a workload don't hit the registry again.
+// Failed verifications are cached with a shorter TTL, so fixed signatures are picked up quickly. Failures which
+// may not occur again, e.g. registry outages, aren't cached.
+type verificationCache struct {
+	results     *cache.LRUExpireCache
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+// newVerificationCache creates the cache, or returns nil if the size is 0 and caching is disabled
+func newVerificationCache(size int, ttl, negativeTTL time.Duration) *verificationCache {
+	if size <= 0 {
+		return nil
+	}
+	return &verificationCache{
+		results:     cache.NewLRUExpireCache(size),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// get returns the cached outcome for the key, ok is false if it isn't cached
+func (vc *verificationCache) get(key string) (result verificationResult, ok bool) {
+	if vc == nil {
+		return verificationResult{}, false
+	}
+	v, ok := vc.results.Get(key)
+	if !ok {
+		cacheMisses.Inc()
+		return verificationResult{}, false
+	}
+	cacheHits.Inc()
+	return v.(verificationResult), true
+}
+
+// add caches the outcome for the key
+func (vc *verificationCache) add(key string, result verificationResult) {
+	if vc == nil {
+		return
+	}
+	ttl := vc.ttl
+	if result.err != nil {
+		if !definiteFailure(result.err) {
+			log.Debugf("Not caching verification result for %s: %v", key, result.err)
+			return
+		}
+		ttl = vc.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	vc.results.Add(key, result, ttl)
+	log.Debugf("Cached verification result for %s for %s", key, ttl)
+}
+
+// definiteFailure reports whether the verification failed because of the signatures or attestations themselves.
+// Configuration errors, e.g. an unreachable KMS, and transient errors may not occur again.
+func definiteFailure(err error) bool {
+	return failureReason(err) != reasonConfig && !transientError(err)
+}
+
+// transientError reports whether the error is a cancelled or timed out request, a network error,
+// or a registry response which may succeed when retried
+func transientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) && (terr.StatusCode == http.StatusTooManyRequests || terr.StatusCode >= http.StatusInternalServerError) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// cacheKey returns the key of the verification of the image digest against the authority,
+// with the signatures stored in the passed repository.
+func cacheKey(digest name.Digest, auth *authority, repo string) string {
+	return strings.Join([]string{digest.String(), auth.fingerprint(), repo}, "|")
+}
+
+// fingerprint identifies the authority and the way it's verified against
+func (a *authority) fingerprint() string {
+	h := sha256.New()
+	if a.identity != nil {
+		h.Write([]byte(strings.Join([]string{"keyless", a.identity.Subject, a.identity.SubjectRegExp, a.identity.Issuer, a.identity.IssuerRegExp}, "\x00")))
+	} else {
+		// the same key encoded differently is the same authority
+		key := strings.TrimSpace(a.pubKey)
+		if fp := pemKeyFingerprint(key); fp != "" {
+			key = fp
+		}
+		h.Write([]byte("key\x00" + key))
+		if a.algorithm != "" {
+			h.Write([]byte("\x00" + strings.ToLower(a.algorithm)))
+		}
+	}
+	if a.tlog {
+		h.Write([]byte("\x00tlog"))
+	}
+	for _, k := range slices.Sorted(maps.Keys(a.annotations)) {
+		fmt.Fprintf(h, "\x00annotation\x00%s=%v", k, a.annotations[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_verificationCache(t *testing.T) {
+	vc := newVerificationCache(10, time.Minute, 0)
+
+	vc.add("verified", verificationResult{annotations: []map[string]any{{"env": "prod"}}})
+	vc.add("failed", verificationResult{err: errors.New("signature mismatch")})
+
+	if r, ok := vc.get("verified"); !ok || r.err != nil || r.annotations[0]["env"] != "prod" {
+		t.Errorf("expected cached successful verification, got %+v, %t", r, ok)
+	}
+	// negative results aren't cached without TTL
+	if _, ok := vc.get("failed"); ok {
+		t.Errorf("expected failed verification not to be cached")
+	}
+	if _, ok := vc.get("unknown"); ok {
+		t.Errorf("expected no result for unknown key")
+	}
+
+	vc = newVerificationCache(10, time.Minute, time.Minute)
+	vc.add("failed", verificationResult{err: errors.New("signature mismatch")})
+	if r, ok := vc.get("failed"); !ok || r.err == nil || r.err.Error() != "signature mismatch" {
+		t.Errorf("expected cached failed verification, got %+v, %t", r, ok)
+	}
+
+	disabled := newVerificationCache(0, time.Minute, time.Minute)
+	disabled.add("verified", verificationResult{})
+	if _, ok := disabled.get("verified"); ok {
+		t.Errorf("expected disabled cache to return nothing")
+	}
+}
+
+func Test_cacheKey(t *testing.T) {
+	digest, err := name.NewDigest("ghcr.io/myorg/app@sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7")
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+	id := &cosign.Identity{Subject: "dev@example.com", Issuer: "https://accounts.example.com"}
+
+	keys := map[string]string{
+		"key":                 cacheKey(digest, &authority{pubKey: "key"}, ""),
+		"other key":           cacheKey(digest, &authority{pubKey: "other key"}, ""),
+		"key and tlog":        cacheKey(digest, &authority{pubKey: "key", tlog: true}, ""),
+		"key and repo":        cacheKey(digest, &authority{pubKey: "key"}, "ghcr.io/myorg/sigs"),
+		"key and alg":         cacheKey(digest, &authority{pubKey: "key", algorithm: "rsa-pss-sha256"}, ""),
+		"key and annotations": cacheKey(digest, &authority{pubKey: "key", annotations: map[string]any{"env": "prod"}}, ""),
+		"keyless":             cacheKey(digest, &authority{identity: id}, ""),
+	}
+	seen := map[string]string{}
+	for n, k := range keys {
+		if other, ok := seen[k]; ok {
+			t.Errorf("expected different cache keys for %q and %q", n, other)
+		}
+		seen[k] = n
+	}
+
+	// the key doesn't depend on the policy the authority is declared in
+	if cacheKey(digest, &authority{pubKey: "key", policy: "ClusterImagePolicy test"}, "") != keys["key"] {
+		t.Errorf("expected same cache key for the same public key")
+	}
+}
+
+func Test_definiteFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "signature mismatch", err: errors.New("no matching signatures"), want: true},
+		{name: "cancelled", err: fmt.Errorf("getting signatures: %w", context.Canceled)},
+		{name: "timed out", err: fmt.Errorf("getting signatures: %w", context.DeadlineExceeded)},
+		{name: "registry unavailable", err: &transport.Error{StatusCode: http.StatusServiceUnavailable}},
+		{name: "rate limited", err: &transport.Error{StatusCode: http.StatusTooManyRequests}},
+		{name: "signatures not found", err: &transport.Error{StatusCode: http.StatusNotFound}, want: true},
+		{name: "network error", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+		{name: "kms unavailable", err: withReason(reasonConfig, errors.New("could not get public key from KMS"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := definiteFailure(tt.err); got != tt.want {
+				t.Errorf("definiteFailure() = %t, want %t", got, tt.want)
+			}
+			vc := newVerificationCache(10, time.Minute, time.Minute)
+			vc.add("failed", verificationResult{err: tt.err})
+			if _, ok := vc.get("failed"); ok != tt.want {
+				t.Errorf("expected failed verification cached %t, got %t", tt.want, ok)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_verifyContainer_registryUnavailable(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer registry.Close()
+
+	image := strings.TrimPrefix(registry.URL, "http://") + "/app@sha256:" + strings.Repeat("ab", 32)
+	digest, err := name.NewDigest(image)
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+	auth := &authority{pubKey: string(testPubKeyPEM(t, testECDSAPubKey(t)))}
+	csh := &CosignServerHandler{cache: newVerificationCache(10, time.Minute, time.Minute)}
+	c := corev1.Container{Name: "app", Image: image}
+	if _, err := csh.verifyContainer(t.Context(), c, []*authority{auth}, authn.NewMultiKeychain(), nil); err == nil {
+		t.Fatal("expected verification to fail")
+	}
+	// the registry outage isn't cached, the next admission retries
+	if r, ok := csh.cache.get(cacheKey(digest, auth, "")); ok {
+		t.Errorf("expected failed verification not to be cached, got %v", r.err)
+	}
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/gookit/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var certExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "cosign_webhook_certificate_expiry_timestamp_seconds",
+	Help: "The expiry of the serving certificate of the webhook as Unix timestamp",
+})
+
+// CertificateSource serves the TLS certificate of the webhook
+type CertificateSource interface {
+	// GetCertificate returns the current certificate, it's meant for tls.Config.GetCertificate
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Ready returns an error if no valid certificate is loaded
+	Ready() error
+}
+
+// servingCert holds the current certificate of a CertificateSource
+type servingCert struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// set replaces the current certificate, it fails if the certificate expired
+func (sc *servingCert) set(cert *tls.Certificate, source string) error {
+	if now := time.Now(); now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired at %s", source, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	sc.mu.Lock()
+	sc.cert = cert
+	sc.mu.Unlock()
+
+	certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	log.Infof("Loaded certificate %s, valid until %s", source, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// GetCertificate returns the current certificate, it's meant for tls.Config.GetCertificate
+func (sc *servingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.cert == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return sc.cert, nil
+}
+
+// Ready returns an error if no certificate is loaded, or it expired and no valid one could be reloaded
+func (sc *servingCert) Ready() error {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.cert == nil {
+		return fmt.Errorf("no certificate loaded")
+	}
+	if notAfter := sc.cert.Leaf.NotAfter; time.Now().After(notAfter) {
+		return fmt.Errorf("certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CertWatcher serves the TLS certificate of the webhook and reloads it when its files change,
+// e.g. when cert-manager rotates the certificate of the mounted Secret.
+type CertWatcher struct {
+	servingCert
+	certFile string
+	keyFile  string
+}
+
+// NewCertWatcher loads the certificate and key, it fails if they aren't a valid and unexpired key pair
+func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
+	cw := &CertWatcher{certFile: certFile, keyFile: keyFile}
+	if err := cw.load(); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// load reads the key pair from the files, the current certificate is kept if it's invalid
+func (cw *CertWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(cw.certFile, cw.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	return cw.set(&cert, cw.certFile)
+}
+
+// Watch reloads the certificate whenever its files change, until the context is done.
+// The directories of the files are watched, as mounted Secrets are updated by swapping a symlink.
+func (cw *CertWatcher) Watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	dirs := []string{filepath.Dir(cw.certFile)}
+	if d := filepath.Dir(cw.keyFile); d != dirs[0] {
+		dirs = append(dirs, d)
+	}
+	for _, d := range dirs {
+		if err := w.Add(d); err != nil {
+			_ = w.Close()
+			return fmt.Errorf("failed to watch %s: %w", d, err)
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Remove) && !ev.Has(fsnotify.Rename) {
+					continue
+				}
+				log.Debugf("Certificate directory changed: %s", ev)
+				// the certificate and key may be written separately, an invalid pair is reloaded on the next event
+				if err := cw.load(); err != nil {
+					log.Warnf("Can't reload certificate, keeping the current one: %v", err)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Error watching certificate files: %v", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewCertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	if _, err := NewCertWatcher(certFile, keyFile); err == nil {
+		t.Error("expected error for missing certificate")
+	}
+
+	testWriteServingCert(t, certFile, keyFile, time.Now().Add(-time.Minute))
+	if _, err := NewCertWatcher(certFile, keyFile); err == nil {
+		t.Error("expected error for expired certificate")
+	}
+
+	testWriteServingCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+	cw, err := NewCertWatcher(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertWatcher() error = %v", err)
+	}
+	if err := cw.Ready(); err != nil {
+		t.Errorf("Ready() error = %v", err)
+	}
+}
+
+func TestCertWatcher_Watch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := testWriteServingCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+
+	cw, err := NewCertWatcher(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertWatcher() error = %v", err)
+	}
+	if err := cw.Watch(t.Context()); err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	serial := func() *big.Int {
+		c, err := cw.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate() error = %v", err)
+		}
+		return c.Leaf.SerialNumber
+	}
+	if got := serial(); got.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("expected certificate %v, got %v", first.SerialNumber, got)
+	}
+
+	// an invalid certificate is ignored
+	if err := os.WriteFile(certFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatalf("failed writing certificate: %v", err)
+	}
+	rotated := testWriteServingCert(t, certFile, keyFile, time.Now().Add(2*time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for serial().Cmp(rotated.SerialNumber) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated certificate %v not reloaded", rotated.SerialNumber)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCosignServerHandler_Readyz_certificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	testWriteServingCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+	cw, err := NewCertWatcher(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertWatcher() error = %v", err)
+	}
+	csh := &CosignServerHandler{certs: cw}
+
+	rec := httptest.NewRecorder()
+	csh.Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	// the loaded certificate expired and wasn't rotated
+	cw.cert.Leaf.NotAfter = time.Now().Add(-time.Minute)
+	rec = httptest.NewRecorder()
+	csh.Readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	// the liveness check doesn't restart the webhook
+	rec = httptest.NewRecorder()
+	csh.Healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", http.NoBody))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+// testWriteServingCert writes a self-signed serving certificate and its key, valid until notAfter
+func testWriteServingCert(t testing.TB, certFile, keyFile string, notAfter time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating ECDSA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "cosignwebhook.cosignwebhook.svc"},
+		DNSNames:     []string{"cosignwebhook.cosignwebhook.svc"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed encoding key: %v", err)
+	}
+	// the key is written first, so the watcher never sees the new certificate with the old key
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed writing key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed writing certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing certificate: %v", err)
+	}
+	return cert
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/gookit/slog"
@@ -20,9 +25,15 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 
 	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -33,10 +44,17 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/cosign/v3/pkg/oci"
 	ociremote "github.com/sigstore/cosign/v3/pkg/oci/remote"
 
+	"github.com/sigstore/sigstore-go/pkg/root"
 	"github.com/sigstore/sigstore/pkg/cryptoutils"
 	"github.com/sigstore/sigstore/pkg/signature"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -48,14 +66,19 @@ const (
 )
 
 var (
-	opsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+	// the admissions are counted by endpoint, with the mutating webhook enabled they're reviewed twice
+	opsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "cosign_processed_ops_total",
 		Help: "The total number of processed events",
-	})
-	verifiedProcessed = promauto.NewCounter(prometheus.CounterOpts{
+	}, []string{"endpoint"})
+	verifiedProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "cosign_processed_verified_total",
 		Help: "The number of verfified events",
-	})
+	}, []string{"container_type", "endpoint"})
+	wouldDenyProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cosign_processed_would_deny_total",
+		Help: "The number of events admitted in warn mode, which would have been denied",
+	}, []string{"endpoint"})
 )
 
 // CosignServerHandler listen to admission requests and serve responses
@@ -64,19 +87,147 @@ var (
 type CosignServerHandler struct {
 	cs kubernetes.Interface
 	eb record.EventBroadcaster
+	// trustRoot holds the Fulcio roots and Rekor keys, nil if not configured
+	trustRoot root.TrustedMaterial
+	// requireTlog requires signatures to be logged in the transparency log, unless overridden by the namespace
+	requireTlog bool
+	// enforce denies pods with unverified containers, unless overridden by the namespace
+	enforce bool
+	// warn admits pods failing verification with a warning, unless overridden by the namespace
+	warn bool
+	// policies holds the image policies, nil if disabled
+	policies *policyStore
+	// cache holds the verification results, nil if disabled
+	cache *verificationCache
+	// workers is the maximum number of containers of a pod verified concurrently
+	workers int
+	// kms caches the public keys of KMS key references, nil disables caching
+	kms *kmsKeys
+	// certs serves the TLS certificate of the webhook, nil if not managed by the handler
+	certs CertificateSource
+	// secrets serves the key Secrets from an informer cache, nil gets them from the API server
+	secrets *secretStore
+	// keychains reuses the registry keychains of pods, nil builds them for every admission
+	keychains *keychainCache
+	// decisions records every admission, nil if disabled
+	decisions *decisionLog
+	// namespaceLabels bounds the namespaces recorded in the metrics, nil records all
+	namespaceLabels *labelLimiter
+	// transport of the registry requests records their duration and spans,
+	// nil uses the default transport
+	transport http.RoundTripper
+	// tracer records the spans of the admissions, nil uses the global tracer provider
+	tracer trace.Tracer
+}
+
+// Config holds the settings of the CosignServerHandler
+type Config struct {
+	// FulcioRootFile is the PEM file with the Fulcio certificate chain for keyless verification.
+	// Keyless verification is disabled if empty.
+	FulcioRootFile string
+	// RekorPubKeyFile is the PEM file with the Rekor public key for offline transparency log verification
+	RekorPubKeyFile string
+	// RequireTlog requires signatures to be logged in the transparency log.
+	// Namespaces may override it with the TlogLabel.
+	RequireTlog bool
+	// Enforce denies pods with containers no public key, keyless identity or image policy was found for.
+	// Namespaces may override it with the EnforceLabel.
+	Enforce bool
+	// Warn admits pods failing verification with a warning instead of denying them.
+	// Namespaces may override it with the WarnLabel.
+	Warn bool
+	// ImagePolicies enables watching the ClusterImagePolicies and ImagePolicies, which are consulted before the env vars
+	ImagePolicies bool
+	// CacheSize is the maximum number of cached verification results, caching is disabled if 0
+	CacheSize int
+	// CacheTTL is the time successful verifications are cached
+	CacheTTL time.Duration
+	// CacheNegativeTTL is the time failed verifications are cached
+	CacheNegativeTTL time.Duration
+	// Workers is the maximum number of containers of a pod verified concurrently
+	Workers int
+	// Certs serves the TLS certificate of the webhook, the handler is unready without a valid certificate
+	Certs CertificateSource
+	// SecretCache watches the Secrets with keys and settings instead of getting them for every admission
+	SecretCache bool
+	// SecretLabelSelector limits the cached Secrets to the matching ones, all Secrets are cached if empty
+	SecretLabelSelector string
+	// KeychainCache reuses the registry keychains of pods with the same service account and pull secrets
+	KeychainCache bool
+	// DecisionLog receives a JSON record of every admission, see OpenDecisionLog. It's disabled if nil.
+	DecisionLog io.Writer
+	// MetricsNamespaces is the maximum number of namespaces recorded in the metrics, later ones are recorded as other
+	MetricsNamespaces int
+	// MetricsRegistries is the maximum number of registries recorded in the metrics, later ones are recorded as other
+	MetricsRegistries int
+	// TracerProvider records the spans of the admissions and registry requests, see NewTracerProvider.
+	// The global tracer provider is used if nil.
+	TracerProvider trace.TracerProvider
 }
 
-func NewCosignServerHandler() *CosignServerHandler {
+func NewCosignServerHandler(cfg Config) *CosignServerHandler {
 	cs, err := restClient()
 	if err != nil {
 		log.Errorf("Can't init rest client: %v", err)
 	}
 	eb := record.NewBroadcaster()
 	eb.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
-	return &CosignServerHandler{
-		cs: cs,
-		eb: eb,
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	csh := &CosignServerHandler{
+		cs:          cs,
+		eb:          eb,
+		requireTlog: cfg.RequireTlog,
+		enforce:     cfg.Enforce,
+		warn:        cfg.Warn,
+		cache:       newVerificationCache(cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeTTL),
+		workers:     cfg.Workers,
+		kms:         newKMSKeys(),
+		certs:       cfg.Certs,
+		decisions:   newDecisionLog(cfg.DecisionLog),
+		// the cardinality of the metrics labels is bounded by the configuration
+		namespaceLabels: newLabelLimiter(cfg.MetricsNamespaces),
+		transport:       newRegistryTransport(remote.DefaultTransport, newLabelLimiter(cfg.MetricsRegistries), tp),
+		tracer:          tp.Tracer(tracerName),
+	}
+	if cfg.FulcioRootFile != "" || cfg.RekorPubKeyFile != "" {
+		csh.trustRoot, err = loadTrustedRoot(cfg.FulcioRootFile, cfg.RekorPubKeyFile)
+		if err != nil {
+			log.Errorf("Can't load trusted root, keyless and transparency log verification disabled: %v", err)
+		}
 	}
+	if (cfg.SecretCache || cfg.KeychainCache) && cs != nil {
+		csh.secrets, csh.keychains, err = watchSecrets(cs, cfg, wait.NeverStop)
+		if err != nil {
+			log.Errorf("Can't watch secrets and service accounts, getting them for every admission: %v", err)
+		}
+	}
+	if cfg.ImagePolicies {
+		csh.policies, err = watchPolicies()
+		if err != nil {
+			log.Errorf("Can't watch image policies: %v", err)
+		}
+	}
+	return csh
+}
+
+// watchPolicies creates the policy store and starts watching the image policies
+func watchPolicies() (*policyStore, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	ps := newPolicyStore()
+	if err := ps.watch(dc, wait.NeverStop); err != nil {
+		return nil, err
+	}
+	return ps, nil
 }
 
 // create restClient for get secrets and create events
@@ -94,20 +245,36 @@ func restClient() (*kubernetes.Clientset, error) {
 	return cs, err
 }
 
-// recordPodVerified emits a PodVerified event for the container
-func (csh *CosignServerHandler) recordPodVerified(p *corev1.Pod) {
+// recordPodVerified emits a PodVerified event for the admitted pod or workload
+func (csh *CosignServerHandler) recordPodVerified(p runtime.Object) {
 	er := csh.eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "Cosignwebhook", Host: os.Getenv("HOSTNAME")})
 	er.Event(p, corev1.EventTypeNormal, "PodVerified", "Signature of pod's images(s) verified successfully")
 }
 
-// recordNoVerification emits a NoVerification event for the container
-func (csh *CosignServerHandler) recordNoVerification(p *corev1.Pod) {
+// recordNoVerification emits a NoVerification event for the admitted pod or workload
+func (csh *CosignServerHandler) recordNoVerification(p runtime.Object) {
 	er := csh.eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "Cosignwebhook", Host: os.Getenv("HOSTNAME")})
 	er.Event(p, corev1.EventTypeNormal, "NoVerification", "No signature verification performed")
 }
 
-// getPod returns the pod object from admission review request
-func getPod(b []byte) (*corev1.Pod, *v1.AdmissionReview, error) {
+// recordVerificationFailed emits a VerificationFailed warning event for the pod or workload admitted in warn mode
+func (csh *CosignServerHandler) recordVerificationFailed(p runtime.Object, msg string) {
+	er := csh.eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "Cosignwebhook", Host: os.Getenv("HOSTNAME")})
+	er.Eventf(p, corev1.EventTypeWarning, "VerificationFailed", "Signature verification failed, admitted in warn mode: %s", msg)
+}
+
+// admittedPod is the pod to verify: the admitted pod, or the pod template of an admitted workload
+type admittedPod struct {
+	*corev1.Pod
+	// object is the admitted object, events are recorded on it
+	object runtime.Object
+	// specPath is the JSON pointer of the pod spec in the admitted object
+	specPath string
+}
+
+// getPod returns the pod to verify from admission review request.
+// For workload controllers, the pod is built from their pod template, so they're denied on submission.
+func getPod(b []byte) (*admittedPod, *v1.AdmissionReview, error) {
 	arRequest := v1.AdmissionReview{}
 	if err := json.Unmarshal(b, &arRequest); err != nil {
 		log.Error("Incorrect body")
@@ -118,22 +285,83 @@ func getPod(b []byte) (*corev1.Pod, *v1.AdmissionReview, error) {
 		return nil, nil, fmt.Errorf("admissionreview request not found")
 	}
 	raw := arRequest.Request.Object.Raw
-	pod := corev1.Pod{}
-	if err := json.Unmarshal(raw, &pod); err != nil {
-		log.Error("Error deserializing container")
+	kind := arRequest.Request.Kind
+
+	var (
+		pod *admittedPod
+		err error
+	)
+	gk := schema.GroupKind{Group: kind.Group, Kind: kind.Kind}
+	switch gk {
+	case corev1.SchemeGroupVersion.WithKind("Pod").GroupKind():
+		pod, err = unmarshalPod(raw)
+	case appsv1.SchemeGroupVersion.WithKind("Deployment").GroupKind():
+		pod, err = unmarshalTemplate(raw, &appsv1.Deployment{}, func(o *appsv1.Deployment) *corev1.PodTemplateSpec { return &o.Spec.Template })
+	case appsv1.SchemeGroupVersion.WithKind("StatefulSet").GroupKind():
+		pod, err = unmarshalTemplate(raw, &appsv1.StatefulSet{}, func(o *appsv1.StatefulSet) *corev1.PodTemplateSpec { return &o.Spec.Template })
+	case appsv1.SchemeGroupVersion.WithKind("DaemonSet").GroupKind():
+		pod, err = unmarshalTemplate(raw, &appsv1.DaemonSet{}, func(o *appsv1.DaemonSet) *corev1.PodTemplateSpec { return &o.Spec.Template })
+	case batchv1.SchemeGroupVersion.WithKind("Job").GroupKind():
+		pod, err = unmarshalTemplate(raw, &batchv1.Job{}, func(o *batchv1.Job) *corev1.PodTemplateSpec { return &o.Spec.Template })
+	case batchv1.SchemeGroupVersion.WithKind("CronJob").GroupKind():
+		pod, err = unmarshalTemplate(raw, &batchv1.CronJob{}, func(o *batchv1.CronJob) *corev1.PodTemplateSpec { return &o.Spec.JobTemplate.Spec.Template })
+		if pod != nil {
+			pod.specPath = "/spec/jobTemplate/spec/template/spec"
+		}
+	default:
+		log.Errorf("Unsupported kind %s", kind.String())
+		return nil, nil, fmt.Errorf("unsupported kind %s", kind.String())
+	}
+	if err != nil {
+		log.Errorf("Error deserializing %s", kind.Kind)
 		return nil, nil, err
 	}
-	return &pod, &arRequest, nil
+	if pod.Namespace == "" {
+		pod.Namespace = arRequest.Request.Namespace
+	}
+	return pod, &arRequest, nil
+}
+
+// unmarshalPod returns the admitted pod
+func unmarshalPod(raw []byte) (*admittedPod, error) {
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		return nil, err
+	}
+	return &admittedPod{Pod: pod, object: pod, specPath: "/spec"}, nil
+}
+
+// unmarshalTemplate returns the pod template of the admitted workload as pod.
+// The pod has the name and namespace of the workload.
+func unmarshalTemplate[T metav1.Object](raw []byte, obj T, template func(T) *corev1.PodTemplateSpec) (*admittedPod, error) {
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return nil, err
+	}
+	ro, ok := any(obj).(runtime.Object)
+	if !ok {
+		return nil, fmt.Errorf("%T is no runtime object", obj)
+	}
+	t := template(obj)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        obj.GetName(),
+			Namespace:   obj.GetNamespace(),
+			Labels:      t.Labels,
+			Annotations: t.Annotations,
+		},
+		Spec: t.Spec,
+	}
+	return &admittedPod{Pod: pod, object: ro, specPath: "/spec/template/spec"}, nil
 }
 
-// getPubKeyFromEnv procures the public key from the container's environment section, if present.
-// Else it returns an empty string and an error.
-func (csh *CosignServerHandler) getPubKeyFromEnv(c *corev1.Container, ns string) (string, error) {
+// getPubKeyFromEnv procures the public key from the container's environment section, if present,
+// along with the version of the Secret it's referencing. Else it returns an empty string and an error.
+func (csh *CosignServerHandler) getPubKeyFromEnv(c *corev1.Container, ns string) (string, *secretVersion, error) {
 	for _, envVar := range c.Env {
 		if envVar.Name == CosignEnvVar {
 			if envVar.Value != "" {
 				log.Debugf("Found public key in env var for container %q", c.Name)
-				return envVar.Value, nil
+				return envVar.Value, nil, nil
 			}
 
 			if envVar.ValueFrom != nil && envVar.ValueFrom.SecretKeyRef != nil {
@@ -146,25 +374,51 @@ func (csh *CosignServerHandler) getPubKeyFromEnv(c *corev1.Container, ns string)
 			}
 		}
 	}
-	return "", fmt.Errorf("no env var found in container %q in namespace %q", c.Name, ns)
+	return "", nil, fmt.Errorf("no env var found in container %q in namespace %q", c.Name, ns)
 }
 
-// getSecretValue returns the value of passed key for the secret with passed name in passed namespace
-func (csh *CosignServerHandler) getSecretValue(namespace, secret, key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
-	defer cancel()
-	s, err := csh.cs.CoreV1().Secrets(namespace).Get(ctx, secret, metav1.GetOptions{})
+// getSettingFor returns the value of the env var of the container, or of the key with the same name
+// in the default secret of the namespace. If neither is set, it returns an empty string.
+func (csh *CosignServerHandler) getSettingFor(c *corev1.Container, ns, key string) string {
+	for _, e := range c.Env {
+		if e.Name == key {
+			return e.Value
+		}
+	}
+	if !csh.useDefaultSecret(ns) {
+		return ""
+	}
+	data, err := csh.getSecretData(ns, "cosignwebhook")
 	if err != nil {
-		log.Debugf("Can't get secret %s/%s : %v", namespace, secret, err)
-		return "", err
+		log.Debugf("Could not find %s in default secret: %v", key, err)
+		return ""
+	}
+	return string(data[key])
+}
+
+// getSecretValue returns the value of passed key for the secret with passed name in passed namespace,
+// along with the version of the secret
+func (csh *CosignServerHandler) getSecretValue(namespace, secret, key string) (string, *secretVersion, error) {
+	s, err := csh.getSecret(namespace, secret)
+	if err != nil {
+		return "", nil, err
 	}
 	value := s.Data[key]
 	if len(value) == 0 {
 		log.Errorf("Secret value of %q is empty for %s/%s", key, namespace, secret)
-		return "", nil
+		return "", nil, nil
 	}
-	log.Debugf("Found public key in secret %s/%s, value: %s", namespace, secret, value)
-	return string(value), nil
+	log.Debugf("Found public key in secret %s/%s", namespace, secret)
+	return string(value), newSecretVersion(s), nil
+}
+
+// getSecretData returns the data of the secret with passed name in passed namespace
+func (csh *CosignServerHandler) getSecretData(namespace, secret string) (map[string][]byte, error) {
+	s, err := csh.getSecret(namespace, secret)
+	if err != nil {
+		return nil, err
+	}
+	return s.Data, nil
 }
 
 // Healthz is called by /healthz for health checks and returns 'ok' if http connection is ready
@@ -177,8 +431,30 @@ func (csh *CosignServerHandler) Healthz(w http.ResponseWriter, _ *http.Request)
 	}
 }
 
-// Serve the main function for /validate to validate the webhook request or /metrics to get Prometheus data
+// Readyz is called by /readyz for readiness checks and returns 'ok' once the caches are synced and a valid
+// certificate is loaded. It's kept apart from /healthz, as restarting the webhook doesn't sync them any faster.
+func (csh *CosignServerHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if csh.policies != nil && !csh.policies.synced() {
+		http.Error(w, "image policies not synced", http.StatusServiceUnavailable)
+		return
+	}
+	if csh.secrets != nil && !csh.secrets.synced() {
+		http.Error(w, "secrets not synced", http.StatusServiceUnavailable)
+		return
+	}
+	if csh.certs != nil {
+		if err := csh.certs.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	csh.Healthz(w, r)
+}
+
+// Serve the main function for /validate to validate the webhook request, /mutate to validate it and pin the
+// images to their verified digest, or /metrics to get Prometheus data
 func (csh *CosignServerHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	var body []byte
 	if r.Body != nil {
 		if data, err := io.ReadAll(r.Body); err == nil {
@@ -193,7 +469,7 @@ func (csh *CosignServerHandler) Serve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Url path of admission
-	if r.URL.Path != "/validate" {
+	if r.URL.Path != "/validate" && r.URL.Path != "/mutate" {
 		log.Error("No validate URI")
 		http.Error(w, "no validate", http.StatusBadRequest)
 		return
@@ -206,58 +482,178 @@ func (csh *CosignServerHandler) Serve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// count each request for prometheus metric
-	opsProcessed.Inc()
+	endpoint := strings.TrimPrefix(r.URL.Path, "/")
+	opsProcessed.WithLabelValues(endpoint).Inc()
 
 	pod, arRequest, err := getPod(body)
 	if err != nil {
-		log.Errorf("Error getPod in %s/%s: %v", pod.Namespace, pod.Name, err)
+		log.Errorf("Error getPod: %v", err)
 		http.Error(w, "incorrect body", http.StatusBadRequest)
 		return
 	}
 
-	ctx := r.Context()
-	kc, err := newKeychainForPod(ctx, pod, csh.cs)
+	d := newDecision(endpoint, arRequest.Request, pod)
+	// the span continues the trace of the API server, if it sent one
+	ctx, span := csh.startSpan(tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), spanAdmission,
+		attribute.String("k8s.namespace.name", d.Namespace),
+		attribute.String("k8s.pod.name", d.Name),
+		attribute.String("cosign.admission.uid", string(d.UID)),
+		attribute.String("cosign.admission.operation", string(d.Operation)),
+		attribute.String("cosign.admission.kind", d.Kind),
+	)
+	defer func() {
+		d.LatencySeconds = time.Since(start).Seconds()
+		csh.decisions.write(d)
+		csh.observeDecision(d)
+		span.SetAttributes(attribute.String("cosign.admission.result", d.Result))
+		span.End()
+	}()
+
+	kcCtx, kcSpan := csh.startSpan(ctx, spanKeychain)
+	kc, err := csh.keychainFor(kcCtx, pod.Pod)
+	endSpan(kcSpan, err)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed initializing k8schain: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	signatureChecked := false
-	for i := range pod.Spec.InitContainers {
-		pubKey := csh.getPubKeyFor(pod.Spec.InitContainers[i], pod.Namespace)
-		if pubKey == "" {
+	nsCfg := csh.getNamespaceConfig(pod.Namespace)
+
+	// every container is evaluated, so all failures are reported at once
+	pcs := podContainers(&pod.Spec, pod.specPath)
+	errs := make([]error, len(pcs))
+	checks := make([]*containerCheck, len(pcs))
+	var verify []*containerCheck
+	for i, pc := range pcs {
+		_, authSpan := csh.startSpan(ctx, spanAuthorities, attribute.String("k8s.container.name", pc.container.Name))
+		auths, err := csh.getAuthoritiesFor(pc.container, nsCfg)
+		authSpan.SetAttributes(attribute.Int("cosign.authorities", len(auths)))
+		endSpan(authSpan, err)
+		if err != nil {
+			log.Errorf("Error getting authorities for %s container %s/%s/%s: %v", pc.kind, pod.Namespace, pod.Name, pc.container.Name, err)
+			errs[i] = withReason(reasonConfig, err)
+			continue
+		}
+		if len(auths) == 0 {
+			if nsCfg.enforce {
+				log.Errorf("No public key, keyless identity or image policy found for %s container %s/%s/%s, denying in enforce mode", pc.kind, pod.Namespace, pod.Name, pc.container.Name)
+				errs[i] = withReason(reasonUnsigned, errors.New("no public key, keyless identity or image policy found, unverified images are denied"))
+			}
 			continue
 		}
+		checks[i] = &containerCheck{podContainer: pc, auths: auths}
+		verify = append(verify, checks[i])
+	}
 
-		err = csh.verifyContainer(ctx, pod.Spec.InitContainers[i], pubKey, kc)
-		if err != nil {
-			log.Errorf("Error verifying init container %s/%s/%s: %v", pod.Namespace, pod.Name, pod.Spec.InitContainers[0].Name, err)
-			deny(w, err.Error(), arRequest.Request.UID)
-			return
+	csh.verifyContainers(ctx, verify, kc, newEvaluationContext(pod, nsCfg))
+
+	var failures []containerFailure
+	for i, pc := range pcs {
+		if cc := checks[i]; cc != nil && cc.err != nil {
+			errs[i] = cc.err
 		}
-		signatureChecked = true
+		if errs[i] != nil {
+			failures = append(failures, containerFailure{podContainer: pc, reason: errs[i].Error()})
+		}
+	}
+	d.addContainers(pcs, checks, errs)
+	if len(failures) > 0 {
+		d.Result = decisionDenied
+		if nsCfg.warn {
+			d.Result = decisionWarned
+			wouldDenyProcessed.WithLabelValues(endpoint).Inc()
+		}
+		csh.reject(w, pod, nsCfg, failures, arRequest.Request.UID)
+		return
 	}
+	d.Result = decisionAllowed
 
-	for i := range pod.Spec.Containers {
-		pubKey := csh.getPubKeyFor(pod.Spec.Containers[i], pod.Namespace)
-		if pubKey == "" {
+	signatureChecked := len(verify) > 0
+	var verifiedBy []string
+	var patch []patchOperation
+	for _, cc := range verify {
+		c := cc.container
+		verifiedProcessed.WithLabelValues(cc.kind, endpoint).Inc()
+		if cc.verified.auth.policy != "" {
+			verifiedBy = append(verifiedBy, fmt.Sprintf("%s (%s)", c.Name, cc.verified.auth.policy))
+		}
+		if !pinnable(arRequest.Request, &cc.podContainer) {
 			continue
 		}
-		err = csh.verifyContainer(ctx, pod.Spec.Containers[i], pubKey, kc)
-		if err != nil {
-			log.Errorf("Error verifying container %s/%s/%s: %v", pod.Namespace, pod.Name, pod.Spec.Containers[i].Name, err)
-			deny(w, err.Error(), arRequest.Request.UID)
-			return
+		if op := pinImage(cc.path+"/image", c.Image, cc.verified.digest); op != nil {
+			patch = append(patch, *op)
 		}
-		signatureChecked = true
 	}
 
-	accept(w, "Cosign verification passed", arRequest.Request.UID)
+	msg := "Cosign verification passed"
+	if len(verifiedBy) > 0 {
+		msg += ", verified by image policy: " + strings.Join(verifiedBy, ", ")
+	}
+	if r.URL.Path == "/mutate" && len(patch) > 0 {
+		mutate(w, msg, patch, arRequest.Request.UID)
+	} else {
+		accept(w, msg, arRequest.Request.UID)
+	}
 	if signatureChecked {
-		csh.recordPodVerified(pod)
+		csh.recordPodVerified(pod.object)
+		return
+	}
+	csh.recordNoVerification(pod.object)
+}
+
+// reject denies the pod listing all failed containers, or admits it with a warning per container
+// if the namespace is in warn mode
+func (csh *CosignServerHandler) reject(w http.ResponseWriter, pod *admittedPod, ns namespaceConfig, failures []containerFailure, uid types.UID) {
+	msg := failureMessage(failures)
+	if !ns.warn {
+		log.Errorf("Denying pod %s/%s: %s", pod.Namespace, pod.Name, msg)
+		deny(w, msg, failureDetails(pod, failures), uid)
 		return
 	}
-	csh.recordNoVerification(pod)
+	log.Warnf("Admitting pod %s/%s in warn mode, it would have been denied: %s", pod.Namespace, pod.Name, msg)
+	warnings := make([]string, 0, len(failures))
+	for _, f := range failures {
+		warnings = append(warnings, f.String())
+	}
+	warn(w, warnings, uid)
+	csh.recordVerificationFailed(pod.object, msg)
+}
+
+// podContainer is a container of the pod spec to verify
+type podContainer struct {
+	container corev1.Container
+	// kind is the container type: init, regular or ephemeral
+	kind string
+	// path is the JSON pointer of the container in the admitted object
+	path string
+}
+
+// podContainers returns the init, regular and ephemeral containers of the pod spec.
+// Ephemeral containers are added by `kubectl debug` and verified like the others.
+func podContainers(spec *corev1.PodSpec, path string) []podContainer {
+	pcs := make([]podContainer, 0, len(spec.InitContainers)+len(spec.Containers)+len(spec.EphemeralContainers))
+	for i := range spec.InitContainers {
+		pcs = append(pcs, podContainer{
+			container: spec.InitContainers[i],
+			kind:      "init",
+			path:      fmt.Sprintf("%s/initContainers/%d", path, i),
+		})
+	}
+	for i := range spec.Containers {
+		pcs = append(pcs, podContainer{
+			container: spec.Containers[i],
+			kind:      "regular",
+			path:      fmt.Sprintf("%s/containers/%d", path, i),
+		})
+	}
+	for i := range spec.EphemeralContainers {
+		pcs = append(pcs, podContainer{
+			container: corev1.Container(spec.EphemeralContainers[i].EphemeralContainerCommon),
+			kind:      "ephemeral",
+			path:      fmt.Sprintf("%s/ephemeralContainers/%d", path, i),
+		})
+	}
+	return pcs
 }
 
 // newKeychainForPod builds a new Keychain for the pod
@@ -281,97 +677,427 @@ func newKeychainForPod(ctx context.Context, pod *corev1.Pod, cs kubernetes.Inter
 	return kc, nil
 }
 
-// getPubKeyFor searches for the public key to verify the container's signature.
-// If no public key is found, it returns an empty string.
-func (csh *CosignServerHandler) getPubKeyFor(c corev1.Container, ns string) string { //nolint:gocritic // better for garbage collection
+// getAuthoritiesFor searches for the authorities to verify the container's signature against.
+// The precedence is:
+//  1. ClusterImagePolicies and ImagePolicies of the namespace matching the container's image,
+//     the image must be verified by both kinds
+//  2. the public key, then the keyless identity, each from the container's environment or
+//     the default cosignwebhook Secret of the namespace. The Secret is ignored once the
+//     namespace has an ImagePolicy.
+//
+// If no authority is found, it returns an empty slice.
+func (csh *CosignServerHandler) getAuthoritiesFor(c corev1.Container, ns namespaceConfig) ([]*authority, error) { //nolint:gocritic // better for garbage collection
+	auths, err := csh.getPolicyAuthoritiesFor(c.Image, ns.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(auths) == 0 {
+		if pubKey, secret := csh.getPubKeyFor(c, ns.name); pubKey != "" {
+			threshold, err := csh.getThresholdFor(&c, ns.name)
+			if err != nil {
+				return nil, err
+			}
+			algorithm := csh.getSettingFor(&c, ns.name, CosignKeyAlgorithmEnvVar)
+			for _, k := range splitPublicKeys(pubKey) {
+				auths = append(auths, &authority{pubKey: k, algorithm: algorithm, secret: secret})
+			}
+			if auths, err = withThreshold(auths, threshold); err != nil {
+				return nil, err
+			}
+		} else if id := csh.getIdentityFor(&c, ns.name); id != nil {
+			auths = append(auths, &authority{identity: id})
+		}
+		if len(auths) > 0 {
+			annotations, err := csh.getAnnotationsFor(&c, ns.name)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range auths {
+				a.annotations = annotations
+			}
+		}
+	}
+	for _, a := range auths {
+		a.tlog = ns.tlog
+	}
+	return auths, nil
+}
+
+// getPubKeyFor searches for the public key to verify the container's signature, along with
+// the version of the Secret it was read from, if any. If no public key is found, it returns an empty string.
+func (csh *CosignServerHandler) getPubKeyFor(c corev1.Container, ns string) (string, *secretVersion) { //nolint:gocritic // better for garbage collection
 	if c.Image == "" {
 		log.Debugf("Container %q has no image, skipping verification", c.Name)
-		return ""
-	}
-	if len(c.Env) == 0 {
-		log.Debugf("Container %q has no env vars, skipping verification", c.Name)
-		return ""
+		return "", nil
 	}
-	pubKey, err := csh.getPubKeyFromEnv(&c, ns)
+	pubKey, secret, err := csh.getPubKeyFromEnv(&c, ns)
 	if err != nil {
 		log.Debugf("Could not find pub key in container's %q environment: %v", c.Name, err)
 	}
 
 	// If no public key get here, try to load default secret
-	// Should be deprecated in future versions
-	if pubKey == "" {
-		pubKey, err = csh.getSecretValue(ns, "cosignwebhook", CosignEnvVar)
+	// Deprecated in favor of the ImagePolicy, which replaces it
+	if pubKey == "" && csh.useDefaultSecret(ns) {
+		pubKey, secret, err = csh.getSecretValue(ns, "cosignwebhook", CosignEnvVar)
 		if err != nil {
 			log.Debugf("Could not find pub key from default secret: %v", err)
 		}
 	}
 
-	// Still no public key, we don't care. Otherwise, POD won't start if we return with 403
-	// In future versions this should block the start of the container
+	// Still no public key, the container is only denied in enforce mode
 	if pubKey == "" {
 		log.Debugf("No public key found for container %q, returning", c.Name)
-		return ""
+		return "", nil
 	}
 
 	log.Debugf("Found public key for container %q", c.Name)
-	return pubKey
+	return pubKey, secret
+}
+
+// containerCheck is the verification of a container against its authorities
+type containerCheck struct {
+	podContainer
+	auths []*authority
+	// verified is set once the container is verified
+	verified *verifiedImage
+	// err is set if the verification failed
+	err error
+}
+
+// dedupKey identifies checks verifying the same image against the same authorities
+func (cc *containerCheck) dedupKey() string {
+	parts := []string{cc.container.Image, getCosignRepository(cc.container.Env)}
+	for _, a := range cc.auths {
+		parts = append(parts, a.fingerprint()+"/"+strconv.Itoa(a.threshold))
+	}
+	return strings.Join(parts, "|")
+}
+
+// verifyContainers verifies the containers concurrently, with at most csh.workers verifications at a time.
+// Containers with the same image and authorities are verified once. The outcome is set on each check,
+// all containers are verified even if one fails.
+func (csh *CosignServerHandler) verifyContainers(ctx context.Context, checks []*containerCheck, kc authn.Keychain, ec *evaluationContext) {
+	var keys []string
+	dedup := map[string][]*containerCheck{}
+	for _, cc := range checks {
+		k := cc.dedupKey()
+		if _, ok := dedup[k]; !ok {
+			keys = append(keys, k)
+		}
+		dedup[k] = append(dedup[k], cc)
+	}
+
+	g := errgroup.Group{}
+	g.SetLimit(max(csh.workers, 1))
+	for _, k := range keys {
+		same := dedup[k]
+		g.Go(func() error {
+			cc := same[0]
+			verified, err := csh.verifyContainer(ctx, cc.container, cc.auths, kc, ec)
+			if err != nil {
+				log.Errorf("Error verifying %s container %s: %v", cc.kind, cc.container.Name, err)
+			}
+			for _, s := range same {
+				s.verified, s.err = verified, err
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+// verifiedImage is the result of a successful container verification
+type verifiedImage struct {
+	// auth is the authority the signature was verified by
+	auth *authority
+	// digest is the digest of the image the signature was verified for
+	digest name.Digest
+	// format of the verified signature, bundle or legacy
+	format string
+	// keyFingerprint is the fingerprint of the public key the signature was verified with, empty for keyless signatures
+	keyFingerprint string
 }
 
 // verifyContainer verifies the signature of the container image.
-// It first attempts verification using the new sigstore bundle format
-// (OCI referrers), then falls back to legacy cosign signature tags.
-func (csh *CosignServerHandler) verifyContainer(ctx context.Context, c corev1.Container, pubKey string, kc authn.Keychain) error { //nolint:gocritic // better for garbage collection
+// The image is resolved to its digest first, so the verified digest is the one returned.
+// The authorities are grouped by their policy, the image is verified once the signatures
+// are verified by the threshold of authorities of any group. If both ClusterImagePolicies and
+// ImagePolicies match, a group of each kind must verify the image.
+func (csh *CosignServerHandler) verifyContainer(ctx context.Context, c corev1.Container, auths []*authority, kc authn.Keychain, ec *evaluationContext) (vi *verifiedImage, err error) { //nolint:gocritic // better for garbage collection
 	log.Debugf("Verifying container %s", c.Name)
+	// the registry requests are traced as children of the container span
+	ctx, span := csh.startSpan(ctx, spanVerifyContainer,
+		attribute.String("k8s.container.name", c.Name),
+		attribute.String("container.image.name", c.Image),
+	)
+	defer func() { endSpan(span, err) }()
 
 	image := c.Image
-	refImage, verifier, err := csh.parseImageAndVerifier(image, pubKey)
+	refImage, err := name.ParseReference(image)
 	if err != nil {
-		return err
+		log.Errorf("Error parsing image reference: %v", err)
+		return nil, withReason(reasonReference, fmt.Errorf("could not parse image reference for image %q", image))
+	}
+
+	remoteOpts, err := csh.buildRemoteOpts(ctx, kc, c.Env)
+	if err != nil {
+		return nil, withReason(reasonConfig, err)
 	}
 
-	remoteOpts, err := csh.buildRemoteOpts(kc, c.Env)
+	_, digestSpan := csh.startSpan(ctx, spanResolveDigest)
+	digest, err := ociremote.ResolveDigest(refImage, remoteOpts...)
+	endSpan(digestSpan, err)
 	if err != nil {
-		return err
+		log.Errorf("Error resolving digest of image %q: %v", image, err)
+		return nil, withReason(reasonRegistry, fmt.Errorf("could not resolve digest for image %q", image))
+	}
+	span.SetAttributes(attribute.String("container.image.digest", digest.DigestStr()))
+
+	repo := getCosignRepository(c.Env)
+	groups := groupAuthorities(auths)
+	if len(groups) == 0 {
+		return nil, withReason(reasonConfig, fmt.Errorf("no authorities to verify image %q against", image))
+	}
+	// the groups of ClusterImagePolicies and ImagePolicies are verified separately
+	verifiedBy := map[bool]*verifiedImage{}
+	errs := map[bool][]error{}
+	for _, g := range groups {
+		if verifiedBy[g.namespaced] != nil {
+			continue
+		}
+		verified, err := csh.verifyGroup(ctx, digest, g, repo, remoteOpts, ec)
+		if err != nil {
+			errs[g.namespaced] = append(errs[g.namespaced], err)
+			continue
+		}
+		verifiedBy[g.namespaced] = verified
+	}
+	for _, g := range groups {
+		if verifiedBy[g.namespaced] == nil {
+			return nil, errors.Join(errs[g.namespaced]...)
+		}
+	}
+	// the image is reported as verified by the first policy, a ClusterImagePolicy if any matched
+	return verifiedBy[groups[0].namespaced], nil
+}
+
+// verifyGroup verifies the signatures of the image against the authorities of the group.
+// Once the threshold is reached, the attestations required by the policy are verified
+// and the policy is evaluated. It returns the image verified by the authority completing the threshold.
+func (csh *CosignServerHandler) verifyGroup(ctx context.Context, digest name.Digest, g *authorityGroup, repo string, remoteOpts []ociremote.Option, ec *evaluationContext) (*verifiedImage, error) {
+	errs := make([]error, 0, len(g.auths))
+	verified := 0
+	// the annotations of the signatures aren't merged, the policy is evaluated against those of each signature
+	var annotations []map[string]any
+	// the signers of each verified authority, a party matching several authorities is only counted once
+	var signers [][]string
+	for _, auth := range g.auths {
+		key := cacheKey(digest, auth, repo)
+		r, cached := csh.cache.get(key)
+		if cached {
+			log.Debugf("Using cached verification result for image %q", digest.String())
+			trace.SpanFromContext(ctx).AddEvent("cached verification result", trace.WithAttributes(attribute.String("cosign.policy", auth.policy)))
+		} else {
+			r = csh.verifyAuthority(ctx, digest, auth, remoteOpts)
+			csh.cache.add(key, r)
+		}
+		if r.err != nil {
+			errs = append(errs, g.wrap(r.err))
+			continue
+		}
+		signers = append(signers, r.signersOf(auth))
+		verified = distinctSigners(signers)
+		annotations = append(annotations, r.annotations...)
+		if verified < g.threshold {
+			continue
+		}
+		attCtx, attSpan := csh.startSpan(ctx, spanAttestations)
+		attestations, err := csh.verifyAttestations(attCtx, digest, g, repo, remoteOpts)
+		endSpan(attSpan, err)
+		if err != nil {
+			return nil, g.wrap(withReason(reasonAttestation, err))
+		}
+		evalCtx, evalSpan := csh.startSpan(ctx, spanEvaluate)
+		err = g.evaluate(evalCtx, digest, annotations, attestations, ec)
+		endSpan(evalSpan, err)
+		if err != nil {
+			return nil, g.wrap(withReason(reasonPolicy, err))
+		}
+		return &verifiedImage{auth: auth, digest: digest, format: r.format, keyFingerprint: r.keyFingerprint}, nil
+	}
+	if verified > 0 {
+		errs = append(errs, g.wrap(withReason(reasonThreshold, fmt.Errorf("signatures of image %q verified by %d of %d required distinct signers", digest.String(), verified, g.threshold))))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// verifyAuthority verifies the signature of the image against a single authority.
+// It returns the format, annotations and key fingerprint of the verified signature, or the error.
+func (csh *CosignServerHandler) verifyAuthority(ctx context.Context, refImage name.Reference, auth *authority, remoteOpts []ociremote.Option) (r verificationResult) {
+	image := refImage.String()
+	ctx, span := csh.startSpan(ctx, spanVerifyAuthority,
+		attribute.String("cosign.policy", auth.policy),
+		attribute.Bool("cosign.keyless", auth.identity != nil),
+		attribute.Bool("cosign.tlog", auth.tlog),
+	)
+	defer func() {
+		span.SetAttributes(attribute.String("cosign.format", r.format))
+		endSpan(span, r.err)
+	}()
+	co, err := csh.buildCheckOpts(ctx, image, auth, remoteOpts)
+	if err != nil {
+		return verificationResult{err: withReason(reasonConfig, err)}
 	}
 
 	log.Debugf("Verifying image %q", image)
 
-	err = csh.verifyBundleSignature(ctx, refImage, verifier, remoteOpts)
+	r, err = csh.verifySignature(ctx, refImage, co)
 	if err != nil {
-		log.Warnf("Failed to verify v3 bundle, trying legacy verification: %v", err)
-		return csh.verifyLegacySignature(ctx, refImage, verifier, remoteOpts)
+		if auth.tlog && csh.verifiedWithoutTlog(ctx, refImage, co) {
+			log.Errorf("Signature of image %q is valid, but its transparency log entry is missing or invalid", image)
+			return verificationResult{err: withReason(reasonTlog, fmt.Errorf("transparency log entry for %q missing or invalid", image))}
+		}
+		if mismatch := csh.annotationMismatch(ctx, refImage, co); mismatch != nil {
+			log.Errorf("Signature of image %q is valid, but its annotations don't match: %v", image, mismatch)
+			return verificationResult{err: withReason(reasonAnnotations, fmt.Errorf("image %q: %w", image, mismatch))}
+		}
+		return verificationResult{err: withReason(reasonSignature, err)}
 	}
 
-	return nil
+	log.Infof("Image %q verified successfully (%s format)", image, r.format)
+	r.keyFingerprint = keyFingerprint(co.SigVerifier)
+	return r
 }
 
-// parseImageAndVerifier parses the image reference and creates a signature verifier from the public key.
-func (csh *CosignServerHandler) parseImageAndVerifier(image, pubKey string) (name.Reference, signature.Verifier, error) {
-	refImage, err := name.ParseReference(image)
+// verifySignature verifies the image signature.
+// It first attempts verification using the new sigstore bundle format
+// (OCI referrers), then falls back to legacy cosign signature tags.
+// It returns the format, and the annotations and signers of the verified signatures.
+func (csh *CosignServerHandler) verifySignature(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) (verificationResult, error) {
+	r, bundleErr := csh.verifyBundleSignature(ctx, refImage, co)
+	if bundleErr == nil {
+		r.format = "bundle"
+		return r, nil
+	}
+
+	log.Warnf("Failed to verify v3 bundle, trying legacy verification: %v", bundleErr)
+	r, err := csh.verifyLegacySignature(ctx, refImage, co)
 	if err != nil {
-		log.Errorf("Error parsing image reference: %v", err)
-		return nil, nil, fmt.Errorf("could not parse image reference for image %q", image)
+		// a registry outage while getting the bundles isn't hidden by the legacy error
+		if transientError(bundleErr) {
+			return verificationResult{}, fmt.Errorf("%w (getting bundles: %w)", err, bundleErr)
+		}
+		return verificationResult{}, err
+	}
+	r.format = "legacy"
+	return r, nil
+}
+
+// verifiedWithoutTlog checks if the image signature is valid when skipping the transparency log.
+// It's used to tell a missing or invalid tlog entry apart from an invalid signature.
+func (csh *CosignServerHandler) verifiedWithoutTlog(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) bool {
+	noTlog := *co
+	noTlog.IgnoreTlog = true
+	noTlog.Offline = false
+	_, err := csh.verifySignature(ctx, refImage, &noTlog)
+	return err == nil
+}
+
+// annotationMismatch verifies the signature again without the required annotations, to tell
+// mismatching annotations from invalid signatures. It returns nil if no annotations are required,
+// or the signature isn't valid either way.
+func (csh *CosignServerHandler) annotationMismatch(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) error {
+	if len(co.Annotations) == 0 {
+		return nil
+	}
+	noAnnotations := *co
+	noAnnotations.Annotations = nil
+	r, err := csh.verifySignature(ctx, refImage, &noAnnotations)
+	if err != nil {
+		return nil
+	}
+	_, err = checkSignatureAnnotations(co.Annotations, r.annotations)
+	return err
+}
+
+// parseVerifier creates a signature verifier from the public key of the image.
+// KMS key references are resolved to their public key first.
+func (csh *CosignServerHandler) parseVerifier(ctx context.Context, image, pubKey, algorithm string) (signature.Verifier, error) {
+	if isKMSRef(pubKey) {
+		var err error
+		pubKey, err = csh.kms.publicKey(ctx, pubKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	publicKey, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(pubKey))
 	if err != nil {
 		log.Errorf("Error unmarshalling public key: %v", err)
-		return nil, nil, fmt.Errorf("public key for image %q malformed", image)
+		return nil, fmt.Errorf("public key for image %q malformed", image)
 	}
 
-	verifier, err := csh.newVerifierForKey(publicKey)
+	verifier, err := csh.newVerifierForKey(publicKey, algorithm)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("public key for image %q: %w", image, err)
+	}
+	return verifier, nil
+}
+
+// buildCheckOpts constructs the cosign check options for verifying the image against the authority.
+// Public keys are checked with a signature verifier, keyless signatures against the Fulcio roots
+// and the expected certificate identity.
+func (csh *CosignServerHandler) buildCheckOpts(ctx context.Context, image string, auth *authority, remoteOpts []ociremote.Option) (*cosign.CheckOpts, error) {
+	co := &cosign.CheckOpts{
+		RegistryClientOpts: remoteOpts,
+		IgnoreSCT:          true,
+		IgnoreTlog:         true,
+		Annotations:        auth.annotations,
+	}
+
+	// the short-lived Fulcio certificates are checked against the time of the log entry, without it
+	// they're checked against the current time and expire minutes after signing
+	if auth.tlog || auth.identity != nil {
+		if csh.trustRoot == nil || len(csh.trustRoot.RekorLogs()) == 0 {
+			log.Errorf("Transparency log verification required for image %q, but no rekor public key configured", image)
+			return nil, fmt.Errorf("transparency log verification for image %q not possible, no rekor public key configured", image)
+		}
+		// entries are verified against the signed entry timestamp or inclusion proof
+		// stored with the signature, rekor itself is never queried
+		co.IgnoreTlog = false
+		co.Offline = true
+		co.TrustedMaterial = csh.trustRoot
+	}
+
+	if auth.identity == nil {
+		verifier, err := csh.verifierFor(ctx, image, auth)
+		if err != nil {
+			return nil, err
+		}
+		co.SigVerifier = verifier
+		return co, nil
 	}
 
-	return refImage, verifier, nil
+	if csh.trustRoot == nil || len(csh.trustRoot.FulcioCertificateAuthorities()) == 0 {
+		log.Errorf("Keyless identity found for image %q, but no fulcio root configured", image)
+		return nil, fmt.Errorf("keyless verification for image %q not possible, no fulcio root configured", image)
+	}
+	if err := validateIdentity(auth.identity); err != nil {
+		return nil, fmt.Errorf("keyless identity for image %q invalid: %w", image, err)
+	}
+	co.TrustedMaterial = csh.trustRoot
+	co.Identities = []cosign.Identity{*auth.identity}
+	return co, nil
 }
 
 // buildRemoteOpts constructs the remote options for registry access.
-func (*CosignServerHandler) buildRemoteOpts(kc authn.Keychain, env []corev1.EnvVar) ([]ociremote.Option, error) {
-	remoteOpts := []ociremote.Option{
-		ociremote.WithRemoteOptions(remote.WithAuthFromKeychain(kc)),
+// Registry requests are canceled with the passed context.
+func (csh *CosignServerHandler) buildRemoteOpts(ctx context.Context, kc authn.Keychain, env []corev1.EnvVar) ([]ociremote.Option, error) {
+	opts := []remote.Option{remote.WithAuthFromKeychain(kc), remote.WithContext(ctx)}
+	if csh.transport != nil {
+		opts = append(opts, remote.WithTransport(csh.transport))
 	}
+	remoteOpts := []ociremote.Option{ociremote.WithRemoteOptions(opts...)}
 
 	if r := getCosignRepository(env); r != "" {
 		repository, err := name.NewRepository(r)
@@ -387,72 +1113,95 @@ func (*CosignServerHandler) buildRemoteOpts(kc authn.Keychain, env []corev1.EnvV
 }
 
 // verifyBundleSignature attempts to verify using the new sigstore bundle format.
-func (*CosignServerHandler) verifyBundleSignature(ctx context.Context, refImage name.Reference, verifier signature.Verifier, remoteOpts []ociremote.Option) error {
-	bundles, _, err := cosign.GetBundles(ctx, refImage, remoteOpts)
+// It returns the annotations and signers of each verified signature carrying the required annotations.
+func (csh *CosignServerHandler) verifyBundleSignature(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) (verificationResult, error) {
+	bundlesCtx, bundlesSpan := csh.startSpan(ctx, spanGetBundles)
+	bundles, _, err := cosign.GetBundles(bundlesCtx, refImage, co.RegistryClientOpts)
+	bundlesSpan.SetAttributes(attribute.Int("cosign.bundles", len(bundles)))
+	endSpan(bundlesSpan, err)
 	if err != nil {
 		log.Debugf("Error getting bundles for image %q: %v", refImage.String(), err)
-		return err
+		return verificationResult{}, err
 	}
 
 	if len(bundles) == 0 {
 		log.Debugf("No bundles found for image %q", refImage.String())
-		return err
+		return verificationResult{}, fmt.Errorf("no bundles found for image %q", refImage.String())
 	}
 
 	log.Debugf("Found %d bundles for image %q, verifying with bundled signature", len(bundles), refImage.String())
 
-	_, _, err = cosign.VerifyImageAttestations(ctx, refImage, &cosign.CheckOpts{
-		RegistryClientOpts: remoteOpts,
-		SigVerifier:        verifier,
-		IgnoreSCT:          true,
-		IgnoreTlog:         true,
-		NewBundleFormat:    true,
-	})
+	bundleOpts := *co
+	bundleOpts.NewBundleFormat = true
+	ctx, span := csh.startSpan(ctx, spanVerifyBundle)
+	sigs, _, err := cosign.VerifyImageAttestations(ctx, refImage, &bundleOpts)
+	endSpan(span, err)
 	if err != nil {
 		log.Errorf("Error verifying bundled signature for image %q: %v", refImage.String(), err)
-		return err
+		return verificationResult{}, err
 	}
 
-	verifiedProcessed.Inc()
-	log.Infof("Image %q verified successfully (bundle format)", refImage.String())
-	return nil
+	// the annotations are on the statement of the bundle, they aren't checked by cosign
+	annotations, err := checkSignatureAnnotations(co.Annotations, bundleAnnotations(sigs))
+	if err != nil {
+		log.Errorf("Error verifying bundled signature for image %q: %v", refImage.String(), err)
+		return verificationResult{}, err
+	}
+	// only the signatures carrying the required annotations are signed by the authority
+	signed := slices.DeleteFunc(sigs, func(sig oci.Signature) bool {
+		a := bundleAnnotations([]oci.Signature{sig})
+		return len(a) == 0 || checkAnnotations(co.Annotations, a[0]) != nil
+	})
+	return verificationResult{annotations: annotations, signers: certSigners(signed)}, nil
 }
 
 // verifyLegacySignature attempts to verify using the legacy cosign signature tags.
-func (*CosignServerHandler) verifyLegacySignature(ctx context.Context, refImage name.Reference, verifier signature.Verifier, remoteOpts []ociremote.Option) error {
+// It returns the annotations and signers of each verified signature, cosign only verifies those carrying the
+// required annotations.
+func (csh *CosignServerHandler) verifyLegacySignature(ctx context.Context, refImage name.Reference, co *cosign.CheckOpts) (r verificationResult, err error) {
 	log.Debugf("Verifying image %q with legacy signature format", refImage.String())
+	ctx, span := csh.startSpan(ctx, spanVerifyLegacy)
+	defer func() { endSpan(span, err) }()
 
-	_, _, err := cosign.VerifyImageSignatures(
-		ctx,
-		refImage,
-		&cosign.CheckOpts{
-			RegistryClientOpts: remoteOpts,
-			SigVerifier:        verifier,
-			IgnoreSCT:          true,
-			IgnoreTlog:         true,
-		},
-	)
+	// the claim verifier checks the digest and the required annotations of the simple signing payload
+	legacyOpts := *co
+	legacyOpts.ClaimVerifier = cosign.SimpleClaimVerifier
+	sigs, _, err := cosign.VerifyImageSignatures(ctx, refImage, &legacyOpts)
 	if err != nil {
 		log.Errorf("Error verifying legacy signature: %v", err)
-		return fmt.Errorf("signature for %q couldn't be verified", refImage.String())
+		return verificationResult{}, fmt.Errorf("signature for %q couldn't be verified: %w", refImage.String(), err)
 	}
 
-	verifiedProcessed.Inc()
-	log.Infof("Image %q verified successfully (legacy format)", refImage.String())
-	return nil
+	return verificationResult{annotations: legacyAnnotations(sigs), signers: certSigners(sigs)}, nil
 }
 
 // newVerifierForKey creates a new signature verifier for the given public key.
-func (*CosignServerHandler) newVerifierForKey(publicKey crypto.PublicKey) (signature.Verifier, error) {
+// The algorithm is derived from the key, unless it's configured explicitly.
+func (*CosignServerHandler) newVerifierForKey(publicKey crypto.PublicKey, algorithm string) (signature.Verifier, error) {
+	alg, err := keyAlgorithm(publicKey, algorithm)
+	if err != nil {
+		log.Errorf("Unsupported public key: %v", err)
+		return nil, err
+	}
 	switch pub := publicKey.(type) {
 	case *ecdsa.PublicKey:
-		return signature.LoadECDSAVerifier(pub, crypto.SHA256)
+		if alg.scheme == schemeECDSA {
+			return signature.LoadECDSAVerifier(pub, alg.hash)
+		}
 	case *rsa.PublicKey:
-		return signature.LoadRSAPKCS1v15Verifier(pub, crypto.SHA256)
-	default:
-		log.Errorf("Unsupported public key type: %v", pub)
-		return nil, fmt.Errorf("unsupported public key type: %v", pub)
+		switch alg.scheme {
+		case schemeRSAPKCS1v15:
+			return signature.LoadRSAPKCS1v15Verifier(pub, alg.hash)
+		case schemeRSAPSS:
+			return signature.LoadRSAPSSVerifier(pub, alg.hash, nil)
+		}
+	case ed25519.PublicKey:
+		if alg.scheme == schemeEd25519 {
+			return signature.LoadED25519Verifier(pub)
+		}
 	}
+	log.Errorf("Signature algorithm %q doesn't match public key type %T", algorithm, publicKey)
+	return nil, fmt.Errorf("signature algorithm %q doesn't match public key type %T", algorithm, publicKey)
 }
 
 // getCosignRepository returns the repository specified by the COSIGN_REPOSITORY environment variable
@@ -467,8 +1216,11 @@ func getCosignRepository(env []corev1.EnvVar) string {
 }
 
 // deny prevents the container from starting
-func deny(w http.ResponseWriter, msg string, uid types.UID) {
-	resp, err := json.Marshal(admissionReview(http.StatusForbidden, false, "Failure", msg, uid))
+func deny(w http.ResponseWriter, msg string, details *metav1.StatusDetails, uid types.UID) {
+	ar := admissionReview(http.StatusForbidden, false, "Failure", msg, uid)
+	ar.Response.Result.Reason = metav1.StatusReasonForbidden
+	ar.Response.Result.Details = details
+	resp, err := json.Marshal(ar)
 	if err != nil {
 		log.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
@@ -494,6 +1246,22 @@ func accept(w http.ResponseWriter, msg string, uid types.UID) {
 	}
 }
 
+// warn allows the container to start, but returns the reasons it would have been denied as warnings
+func warn(w http.ResponseWriter, warnings []string, uid types.UID) {
+	ar := admissionReview(http.StatusOK, true, "Success", "Cosign verification failed, admitted in warn mode", uid)
+	ar.Response.Warnings = warnings
+	resp, err := json.Marshal(ar)
+	if err != nil {
+		log.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 // admissionReview returns a AdmissionReview object with the passed parameters
 func admissionReview(admissionCode int32, admissionPermissions bool, admissionStatus, admissionMessage string, requestUID types.UID) v1.AdmissionReview {
 	return v1.AdmissionReview{
@@ -3,14 +3,30 @@ package webhook
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/sigstore/pkg/signature"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 )
 
 func Test_getPubKeyFromEnv(t *testing.T) {
@@ -133,7 +149,7 @@ func Test_getPubKeyFromEnv(t *testing.T) {
 				cs: c,
 			}
 
-			got, err := chs.getPubKeyFromEnv(tt.container, "test")
+			got, _, err := chs.getPubKeyFromEnv(tt.container, "test")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getPubKeyFromEnv() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -147,17 +163,59 @@ func Test_getPubKeyFromEnv(t *testing.T) {
 
 func TestCosignServerHandler_newVerifierForKey(t *testing.T) {
 	tests := []struct {
-		name    string
-		pubkey  crypto.PublicKey
-		wantErr bool
+		name      string
+		pubkey    crypto.PublicKey
+		algorithm string
+		wantType  signature.Verifier
+		wantErr   bool
 	}{
 		{
-			name:   "success RSA",
-			pubkey: testRSAPubKey(t),
+			name:     "success RSA",
+			pubkey:   testRSAPubKey(t),
+			wantType: &signature.RSAPKCS1v15Verifier{},
+		},
+		{
+			name:      "success RSA-PSS",
+			pubkey:    testRSAPubKey(t),
+			algorithm: "rsa-pss-sha256",
+			wantType:  &signature.RSAPSSVerifier{},
+		},
+		{
+			name:     "success ECDSA",
+			pubkey:   testECDSAPubKey(t),
+			wantType: &signature.ECDSAVerifier{},
+		},
+		{
+			name:     "success ECDSA P-384",
+			pubkey:   testECDSACurvePubKey(t, elliptic.P384()),
+			wantType: &signature.ECDSAVerifier{},
 		},
 		{
-			name:   "success ECDSA",
-			pubkey: testECDSAPubKey(t),
+			name:     "success ECDSA P-521",
+			pubkey:   testECDSACurvePubKey(t, elliptic.P521()),
+			wantType: &signature.ECDSAVerifier{},
+		},
+		{
+			name:     "success Ed25519",
+			pubkey:   testEd25519PubKey(t),
+			wantType: &signature.ED25519Verifier{},
+		},
+		{
+			name:    "fail: unsupported curve",
+			pubkey:  testECDSACurvePubKey(t, elliptic.P224()),
+			wantErr: true,
+		},
+		{
+			name:      "fail: unsupported algorithm",
+			pubkey:    testRSAPubKey(t),
+			algorithm: "rsa-sha1",
+			wantErr:   true,
+		},
+		{
+			name:      "fail: algorithm doesn't match key",
+			pubkey:    testECDSAPubKey(t),
+			algorithm: "rsa-pss-sha256",
+			wantErr:   true,
 		},
 		{
 			name:    "fail empty public key",
@@ -175,7 +233,7 @@ func TestCosignServerHandler_newVerifierForKey(t *testing.T) {
 
 		csh := &CosignServerHandler{}
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := csh.newVerifierForKey(tt.pubkey)
+			got, err := csh.newVerifierForKey(tt.pubkey, tt.algorithm)
 
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("verifySignature() error = %v, wantErr %v", err, tt.wantErr)
@@ -184,10 +242,448 @@ func TestCosignServerHandler_newVerifierForKey(t *testing.T) {
 			if !tt.wantErr && got == nil {
 				t.Fatal("expected key to produce verifier")
 			}
+			if !tt.wantErr && reflect.TypeOf(got) != reflect.TypeOf(tt.wantType) {
+				t.Errorf("newVerifierForKey() got %T, want %T", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_buildCheckOpts(t *testing.T) {
+	rootCert, _ := testCACert(t, "root", nil, nil)
+	trustRoot, err := newTrustedRoot(testCertsPEM(t, rootCert), testPubKeyPEM(t, testECDSAPubKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fulcioOnly, err := newTrustedRoot(testCertsPEM(t, rootCert), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := testPubKeyPEM(t, testECDSAPubKey(t))
+	identity := &cosign.Identity{Subject: "dev@example.com", Issuer: "https://accounts.example.com"}
+
+	tests := []struct {
+		name        string
+		csh         *CosignServerHandler
+		auth        *authority
+		wantKeyless bool
+		wantTlog    bool
+		wantErr     bool
+	}{
+		{
+			name: "public key",
+			csh:  &CosignServerHandler{},
+			auth: &authority{pubKey: string(pubKey)},
+		},
+		{
+			name:    "malformed public key",
+			csh:     &CosignServerHandler{},
+			auth:    &authority{pubKey: "i'm not a key!"},
+			wantErr: true,
+		},
+		{
+			name:        "keyless identity",
+			csh:         &CosignServerHandler{trustRoot: trustRoot},
+			auth:        &authority{identity: identity},
+			wantKeyless: true,
+			wantTlog:    true,
+		},
+		{
+			name:    "keyless identity without rekor key",
+			csh:     &CosignServerHandler{trustRoot: fulcioOnly},
+			auth:    &authority{identity: identity},
+			wantErr: true,
+		},
+		{
+			name:    "keyless identity without fulcio root",
+			csh:     &CosignServerHandler{},
+			auth:    &authority{identity: identity},
+			wantErr: true,
+		},
+		{
+			name:    "keyless identity without issuer",
+			csh:     &CosignServerHandler{trustRoot: trustRoot},
+			auth:    &authority{identity: &cosign.Identity{Subject: "dev@example.com"}},
+			wantErr: true,
+		},
+		{
+			name:     "public key with tlog",
+			csh:      &CosignServerHandler{trustRoot: trustRoot},
+			auth:     &authority{pubKey: string(pubKey), tlog: true},
+			wantTlog: true,
+		},
+		{
+			name:        "keyless identity with tlog",
+			csh:         &CosignServerHandler{trustRoot: trustRoot},
+			auth:        &authority{identity: identity, tlog: true},
+			wantKeyless: true,
+			wantTlog:    true,
+		},
+		{
+			name:    "tlog without rekor key",
+			csh:     &CosignServerHandler{trustRoot: fulcioOnly},
+			auth:    &authority{pubKey: string(pubKey), tlog: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			co, err := tt.csh.buildCheckOpts(t.Context(), "busybox", tt.auth, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildCheckOpts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantKeyless && (co.TrustedMaterial == nil || len(co.Identities) != 1 || co.SigVerifier != nil) {
+				t.Errorf("expected keyless check options, got %+v", co)
+			}
+			if !tt.wantKeyless && co.SigVerifier == nil {
+				t.Errorf("expected signature verifier, got %+v", co)
+			}
+			if co.IgnoreTlog == tt.wantTlog {
+				t.Errorf("expected IgnoreTlog %t, got %t", !tt.wantTlog, co.IgnoreTlog)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_reject(t *testing.T) {
+	tests := []struct {
+		name         string
+		warn         bool
+		wantAllowed  bool
+		wantWarnings []string
+	}{
+		{
+			name: "deny",
+		},
+		{
+			name:         "admit with warning in warn mode",
+			warn:         true,
+			wantAllowed:  true,
+			wantWarnings: []string{`container "app" (image "app:1.0"): signature mismatch`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csh := &CosignServerHandler{eb: record.NewBroadcaster()}
+			p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"}}
+			pod := &admittedPod{Pod: p, object: p, specPath: "/spec"}
+			w := httptest.NewRecorder()
+
+			failures := []containerFailure{{
+				podContainer: podContainer{container: corev1.Container{Name: "app", Image: "app:1.0"}, kind: "regular", path: "/spec/containers/0"},
+				reason:       "signature mismatch",
+			}}
+
+			csh.reject(w, pod, namespaceConfig{name: "test", warn: tt.warn}, failures, "uid")
+
+			ar := v1.AdmissionReview{}
+			if err := json.Unmarshal(w.Body.Bytes(), &ar); err != nil {
+				t.Fatalf("failed decoding response: %v", err)
+			}
+			if ar.Response.Allowed != tt.wantAllowed {
+				t.Errorf("expected allowed %t, got %t", tt.wantAllowed, ar.Response.Allowed)
+			}
+			if len(ar.Response.Warnings) != len(tt.wantWarnings) || (len(tt.wantWarnings) > 0 && ar.Response.Warnings[0] != tt.wantWarnings[0]) {
+				t.Errorf("expected warnings %v, got %v", tt.wantWarnings, ar.Response.Warnings)
+			}
+			if tt.warn {
+				return
+			}
+			if want := `verification failed for 1 container(s): container "app" (image "app:1.0"): signature mismatch`; ar.Response.Result.Message != want {
+				t.Errorf("expected denial message %q, got %q", want, ar.Response.Result.Message)
+			}
+			causes := ar.Response.Result.Details.Causes
+			if len(causes) != 1 || causes[0].Field != "spec.containers[0].image" || causes[0].Message != "signature mismatch" {
+				t.Errorf("expected cause for the image of container app, got %+v", causes)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_Serve_enforce(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test", Labels: map[string]string{EnforceLabel: "true"}}}
+	defaultSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosignwebhook", Namespace: "test"},
+		Data:       map[string][]byte{CosignEnvVar: testPubKeyPEM(t, testECDSAPubKey(t))},
+	}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    string
+	}{
+		{
+			name:    "container without env denied without authorities",
+			objects: []runtime.Object{ns},
+			want:    "no public key, keyless identity or image policy found",
+		},
+		{
+			name:    "container without env verified against default secret",
+			objects: []runtime.Object{ns, defaultSecret},
+			want:    "could not parse image reference",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csh := &CosignServerHandler{cs: fake.NewSimpleClientset(tt.objects...), eb: record.NewBroadcaster()}
+			pod := &corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "INVALID::image"}}},
+			}
+			body, err := json.Marshal(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+				UID:       "uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Namespace: "test",
+				Operation: v1.Create,
+				Object:    runtime.RawExtension{Object: pod},
+			}})
+			if err != nil {
+				t.Fatalf("failed encoding admission review: %v", err)
+			}
+			w := httptest.NewRecorder()
+			csh.Serve(w, httptest.NewRequest("POST", "/validate", strings.NewReader(string(body))))
+
+			ar := v1.AdmissionReview{}
+			if err := json.Unmarshal(w.Body.Bytes(), &ar); err != nil {
+				t.Fatalf("failed decoding response %q: %v", w.Body.String(), err)
+			}
+			if ar.Response.Allowed {
+				t.Fatal("expected pod to be denied")
+			}
+			if !strings.Contains(ar.Response.Result.Message, tt.want) {
+				t.Errorf("expected denial message containing %q, got %q", tt.want, ar.Response.Result.Message)
+			}
+		})
+	}
+}
+
+func Test_podContainers(t *testing.T) {
+	spec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", Image: "init:1.0"}},
+		Containers:     []corev1.Container{{Name: "app", Image: "app:1.0"}, {Name: "sidecar", Image: "sidecar:1.0"}},
+		EphemeralContainers: []corev1.EphemeralContainer{
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "debug:1.0"}},
+		},
+	}
+	want := []struct{ name, image, kind, path string }{
+		{"init", "init:1.0", "init", "/spec/initContainers/0"},
+		{"app", "app:1.0", "regular", "/spec/containers/0"},
+		{"sidecar", "sidecar:1.0", "regular", "/spec/containers/1"},
+		{"debugger", "debug:1.0", "ephemeral", "/spec/ephemeralContainers/0"},
+	}
+
+	got := podContainers(spec, "/spec")
+	if len(got) != len(want) {
+		t.Fatalf("expected %d containers, got %d", len(want), len(got))
+	}
+	for i, w := range want {
+		if got[i].container.Name != w.name || got[i].container.Image != w.image || got[i].kind != w.kind || got[i].path != w.path {
+			t.Errorf("expected container %+v, got %s %s %s %s", w, got[i].container.Name, got[i].container.Image, got[i].kind, got[i].path)
+		}
+	}
+}
+
+func Test_getPod(t *testing.T) {
+	spec := corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}}}
+	labels, annotations := map[string]string{"app": "test"}, map[string]string{"team": "shop"}
+	// the policies see the metadata of the pod template
+	template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations}, Spec: spec}
+	meta := metav1.ObjectMeta{Name: "test", Namespace: "test"}
+	tests := []struct {
+		name         string
+		kind         metav1.GroupVersionKind
+		object       any
+		wantSpecPath string
+		wantErr      bool
+	}{
+		{
+			name:         "pod",
+			kind:         metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			object:       &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test", Labels: labels, Annotations: annotations}, Spec: spec},
+			wantSpecPath: "/spec",
+		},
+		{
+			name:         "deployment",
+			kind:         metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			object:       &appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: template}},
+			wantSpecPath: "/spec/template/spec",
+		},
+		{
+			name:         "statefulset",
+			kind:         metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+			object:       &appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: template}},
+			wantSpecPath: "/spec/template/spec",
+		},
+		{
+			name:         "daemonset",
+			kind:         metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+			object:       &appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: template}},
+			wantSpecPath: "/spec/template/spec",
+		},
+		{
+			name:         "job",
+			kind:         metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+			object:       &batchv1.Job{ObjectMeta: meta, Spec: batchv1.JobSpec{Template: template}},
+			wantSpecPath: "/spec/template/spec",
+		},
+		{
+			name: "cronjob",
+			kind: metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+			object: &batchv1.CronJob{ObjectMeta: meta, Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+			}},
+			wantSpecPath: "/spec/jobTemplate/spec/template/spec",
+		},
+		{
+			name:    "unsupported kind",
+			kind:    metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+			object:  &appsv1.ReplicaSet{ObjectMeta: meta},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.object)
+			if err != nil {
+				t.Fatalf("failed encoding object: %v", err)
+			}
+			body, err := json.Marshal(v1.AdmissionReview{Request: &v1.AdmissionRequest{
+				UID:       "uid",
+				Kind:      tt.kind,
+				Namespace: "test",
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			if err != nil {
+				t.Fatalf("failed encoding admission review: %v", err)
+			}
+
+			pod, _, err := getPod(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getPod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if pod.Name != "test" || pod.Namespace != "test" {
+				t.Errorf("expected pod test/test, got %s/%s", pod.Namespace, pod.Name)
+			}
+			if len(pod.Spec.Containers) != 1 || pod.Spec.Containers[0].Image != "app:1.0" {
+				t.Errorf("expected pod spec of the object, got %+v", pod.Spec)
+			}
+			if !reflect.DeepEqual(pod.Labels, labels) || !reflect.DeepEqual(pod.Annotations, annotations) {
+				t.Errorf("expected labels %v and annotations %v, got %v and %v", labels, annotations, pod.Labels, pod.Annotations)
+			}
+			if pod.specPath != tt.wantSpecPath {
+				t.Errorf("expected spec path %q, got %q", tt.wantSpecPath, pod.specPath)
+			}
+			if pod.object == nil {
+				t.Errorf("expected admitted object")
+			}
+		})
+	}
+}
+
+func Test_containerCheck_dedupKey(t *testing.T) {
+	check := func(image, repo, key string) *containerCheck {
+		c := corev1.Container{Name: "test", Image: image}
+		if repo != "" {
+			c.Env = []corev1.EnvVar{{Name: CosignRepositoryEnvVar, Value: repo}}
+		}
+		return &containerCheck{podContainer: podContainer{container: c}, auths: []*authority{{pubKey: key}}}
+	}
+
+	base := check("app:1.0", "", "key").dedupKey()
+	if got := check("app:1.0", "", "key").dedupKey(); got != base {
+		t.Errorf("expected same key for the same image and authority")
+	}
+	for name, cc := range map[string]*containerCheck{
+		"other image":      check("app:2.0", "", "key"),
+		"other repository": check("app:1.0", "registry/sigs", "key"),
+		"other key":        check("app:1.0", "", "other key"),
+	} {
+		if cc.dedupKey() == base {
+			t.Errorf("expected different key for %s", name)
+		}
+	}
+}
+
+func TestCosignServerHandler_verifyContainer_policyKinds(t *testing.T) {
+	image := "registry.example.com/app@sha256:" + strings.Repeat("ab", 32)
+	digest, err := name.NewDigest(image)
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+	cluster := &authority{pubKey: "cluster key", policy: "ClusterImagePolicy platform"}
+	tenant := &authority{pubKey: "tenant key", policy: "ImagePolicy tenant/all", namespaced: true}
+	tenantOther := &authority{pubKey: "other tenant key", policy: "ImagePolicy tenant/other", namespaced: true}
+	verified := verificationResult{format: "bundle"}
+	failed := verificationResult{err: errors.New("no matching signatures")}
+
+	tests := []struct {
+		name       string
+		results    map[*authority]verificationResult
+		wantPolicy string
+		wantErr    bool
+	}{
+		{
+			name:       "verified by both kinds",
+			results:    map[*authority]verificationResult{cluster: verified, tenant: failed, tenantOther: verified},
+			wantPolicy: cluster.policy,
+		},
+		{
+			name:    "image policy can't override cluster policy",
+			results: map[*authority]verificationResult{cluster: failed, tenant: verified, tenantOther: verified},
+			wantErr: true,
+		},
+		{
+			name:    "image policy of the namespace must be met too",
+			results: map[*authority]verificationResult{cluster: verified, tenant: failed, tenantOther: failed},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the results are cached, so the registry isn't queried
+			csh := &CosignServerHandler{cache: newVerificationCache(10, time.Minute, time.Minute)}
+			for a, r := range tt.results {
+				csh.cache.add(cacheKey(digest, a, ""), r)
+			}
+			c := corev1.Container{Name: "app", Image: image}
+			got, err := csh.verifyContainer(t.Context(), c, []*authority{cluster, tenant, tenantOther}, authn.NewMultiKeychain(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.auth.policy != tt.wantPolicy {
+				t.Errorf("expected image verified by %q, got %q", tt.wantPolicy, got.auth.policy)
+			}
 		})
 	}
 }
 
+func TestCosignServerHandler_verifyContainers(t *testing.T) {
+	csh := &CosignServerHandler{workers: 2}
+	csh.verifyContainers(t.Context(), nil, nil, nil)
+
+	checks := []*containerCheck{
+		{podContainer: podContainer{container: corev1.Container{Name: "a", Image: "INVALID::image"}}, auths: []*authority{{pubKey: "key"}}},
+		{podContainer: podContainer{container: corev1.Container{Name: "b", Image: "INVALID::image"}}, auths: []*authority{{pubKey: "key"}}},
+		{podContainer: podContainer{container: corev1.Container{Name: "c", Image: "INVALID::other"}}, auths: []*authority{{pubKey: "key"}}},
+	}
+	csh.verifyContainers(t.Context(), checks, nil, nil)
+	for _, cc := range checks {
+		if cc.verified != nil || cc.err == nil {
+			t.Errorf("expected container %s to fail verification", cc.container.Name)
+		}
+	}
+}
+
 // testECDSAPubKey creates an ECDSA keypair and returns the public key
 func testECDSAPubKey(t testing.TB) crypto.PublicKey {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -198,6 +694,26 @@ func testECDSAPubKey(t testing.TB) crypto.PublicKey {
 	return &key.PublicKey
 }
 
+// testECDSACurvePubKey creates an ECDSA keypair on the curve and returns the public key
+func testECDSACurvePubKey(t testing.TB, curve elliptic.Curve) crypto.PublicKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Errorf("failed generating ECDSA key: %v", err)
+		return nil
+	}
+	return &key.PublicKey
+}
+
+// testEd25519PubKey creates an Ed25519 keypair and returns the public key
+func testEd25519PubKey(t testing.TB) crypto.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Errorf("failed generating Ed25519 key: %v", err)
+		return nil
+	}
+	return pub
+}
+
 // testRSAPubKey creates an RSA keypair and returns the public key
 func testRSAPubKey(t testing.TB) crypto.PublicKey {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
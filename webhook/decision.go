@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/gookit/slog"
+	"github.com/gookit/slog/rotatefile"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// results of an admission in the decision log
+const (
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+	// decisionWarned is an admission in warn mode, which would have been denied
+	decisionWarned = "warned"
+	// decisionError is an admission failing before its containers were verified
+	decisionError = "error"
+)
+
+// results of a container in the decision log
+const (
+	containerVerified = "verified"
+	containerFailed   = "failed"
+	// containerSkipped is a container without public key, keyless identity or image policy
+	containerSkipped = "skipped"
+)
+
+// decision is the record of an admission in the decision log.
+// It never contains key material, public keys are identified by their fingerprint. The endpoint is the webhook
+// reviewing the admission, validate or mutate, with the mutating webhook enabled an admission is reviewed by both.
+type decision struct {
+	Time           time.Time           `json:"time"`
+	Endpoint       string              `json:"endpoint"`
+	UID            types.UID           `json:"uid"`
+	Operation      v1.Operation        `json:"operation"`
+	Kind           string              `json:"kind"`
+	Namespace      string              `json:"namespace"`
+	Name           string              `json:"name"`
+	User           decisionUser        `json:"user"`
+	Result         string              `json:"result"`
+	LatencySeconds float64             `json:"latencySeconds"`
+	Containers     []containerDecision `json:"containers"`
+}
+
+// decisionUser is the user requesting the admission
+type decisionUser struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// containerDecision is the outcome of the verification of a container
+type containerDecision struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+	// Policy is the image policy the container was verified by, empty for env vars and the default Secret
+	Policy         string `json:"policy,omitempty"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	Identity       string `json:"identity,omitempty"`
+	Issuer         string `json:"issuer,omitempty"`
+	Format         string `json:"format,omitempty"`
+	// ReasonClass is the class of the failure reason, e.g. signature, registry or policy
+	ReasonClass string `json:"reasonClass,omitempty"`
+}
+
+// newDecision starts the record of the admission of the pod by the endpoint, it's an error until the result is set
+func newDecision(endpoint string, req *v1.AdmissionRequest, pod *admittedPod) *decision {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	return &decision{
+		Time:      time.Now().UTC(),
+		Endpoint:  endpoint,
+		UID:       req.UID,
+		Operation: req.Operation,
+		Kind:      req.Kind.Kind,
+		Namespace: pod.Namespace,
+		Name:      name,
+		User: decisionUser{
+			Username: req.UserInfo.Username,
+			UID:      req.UserInfo.UID,
+			Groups:   req.UserInfo.Groups,
+		},
+		Result: decisionError,
+	}
+}
+
+// addContainers records the outcome of the containers, checks and errs are indexed like the containers
+func (d *decision) addContainers(pcs []podContainer, checks []*containerCheck, errs []error) {
+	for i, pc := range pcs {
+		cd := containerDecision{
+			Name:   pc.container.Name,
+			Type:   pc.kind,
+			Image:  pc.container.Image,
+			Result: containerSkipped,
+		}
+		switch {
+		case errs[i] != nil:
+			cd.Result = containerFailed
+			cd.Reason = errs[i].Error()
+			cd.ReasonClass = failureReason(errs[i])
+		case checks[i] != nil && checks[i].verified != nil:
+			v := checks[i].verified
+			cd.Result = containerVerified
+			cd.Digest = v.digest.DigestStr()
+			cd.Policy = v.auth.policy
+			cd.KeyFingerprint = v.keyFingerprint
+			cd.Format = v.format
+			if id := v.auth.identity; id != nil {
+				cd.Identity = firstNonEmpty(id.Subject, id.SubjectRegExp)
+				cd.Issuer = firstNonEmpty(id.Issuer, id.IssuerRegExp)
+			}
+		}
+		d.Containers = append(d.Containers, cd)
+	}
+}
+
+// verified reports whether any container was verified
+func (d *decision) verified() bool {
+	for _, c := range d.Containers {
+		if c.Result == containerVerified {
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// decisionLog writes one JSON record per admission, separate from the text log
+type decisionLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newDecisionLog creates the decision log, or returns nil if the writer is nil and the log is disabled
+func newDecisionLog(w io.Writer) *decisionLog {
+	if w == nil {
+		return nil
+	}
+	return &decisionLog{w: w}
+}
+
+// write appends the record as a single line
+func (dl *decisionLog) write(d *decision) {
+	if dl == nil {
+		return
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Errorf("Can't encode decision of %s: %v", d.UID, err)
+		return
+	}
+	b = append(b, '\n')
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if _, err := dl.w.Write(b); err != nil {
+		log.Errorf("Can't write decision of %s: %v", d.UID, err)
+	}
+}
+
+// OpenDecisionLog returns the writer of the decision log: stdout if the path is empty or "-", else the file,
+// rotated once it exceeds maxSize megabytes, keeping the passed number of rotated files.
+func OpenDecisionLog(path string, maxSize, backups uint) (io.Writer, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	w, err := rotatefile.NewConfig(path, func(c *rotatefile.Config) {
+		c.MaxSize = uint64(maxSize) * 1024 * 1024
+		// rotated by size only
+		c.RotateTime = 0
+		c.BackupNum = backups
+		c.BackupTime = 0
+		c.FilePerm = 0o640
+	}).Create()
+	if err != nil {
+		return nil, fmt.Errorf("could not open decision log %s: %w", path, err)
+	}
+	return w, nil
+}
@@ -0,0 +1,152 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/sigstore/pkg/signature"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_keyFingerprint(t *testing.T) {
+	pub := testECDSAPubKey(t)
+	verifier, err := signature.LoadECDSAVerifier(pub.(*ecdsa.PublicKey), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed loading verifier: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed encoding public key: %v", err)
+	}
+	sum := sha256.Sum256(der)
+
+	if got, want := keyFingerprint(verifier), "SHA256:"+hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("keyFingerprint() = %q, want %q", got, want)
+	}
+	if got := keyFingerprint(nil); got != "" {
+		t.Errorf("expected no fingerprint for keyless verification, got %q", got)
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	digest, err := name.NewDigest("registry.example.com/app@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+	pubKey := string(testPubKeyPEM(t, testECDSAPubKey(t)))
+	pod := &admittedPod{Pod: &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "app-7d9c6b-", Namespace: "shop"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "registry.example.com/init:1.0"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "registry.example.com/app:1.0"},
+				{Name: "sidecar", Image: "registry.example.com/sidecar:1.0"},
+			},
+		},
+	}}
+	req := &v1.AdmissionRequest{
+		UID:       "6f1c",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: v1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+	}
+	pcs := podContainers(&pod.Spec, "/spec")
+	checks := []*containerCheck{
+		nil,
+		{podContainer: pcs[1], verified: &verifiedImage{
+			auth:           &authority{pubKey: pubKey, policy: "ClusterImagePolicy myorg"},
+			digest:         digest,
+			format:         "bundle",
+			keyFingerprint: "SHA256:9b1f",
+		}},
+		{podContainer: pcs[2], verified: &verifiedImage{
+			auth:   &authority{identity: &cosign.Identity{Subject: "builder@example.com", IssuerRegExp: ".*"}},
+			digest: digest,
+			format: "legacy",
+		}},
+	}
+	errs := []error{withReason(reasonUnsigned, errors.New("no public key, keyless identity or image policy found, unverified images are denied")), nil, nil}
+
+	d := newDecision("validate", req, pod)
+	if d.Result != decisionError {
+		t.Errorf("expected decision to be an error until the result is set, got %q", d.Result)
+	}
+	d.addContainers(pcs, checks, errs)
+	d.Result = decisionDenied
+	var buf bytes.Buffer
+	newDecisionLog(&buf).write(d)
+
+	if strings.Contains(buf.String(), "PUBLIC KEY") {
+		t.Errorf("decision log contains key material: %s", buf.String())
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("expected a single line, got %d", n)
+	}
+	var got decision
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid decision record: %v", err)
+	}
+	if got.Endpoint != "validate" || got.UID != "6f1c" || got.Kind != "Pod" || got.Name != "app-7d9c6b-" || got.Namespace != "shop" || got.Result != decisionDenied {
+		t.Errorf("unexpected admission in decision %+v", got)
+	}
+	if got.User.Username != req.UserInfo.Username {
+		t.Errorf("expected user %q, got %q", req.UserInfo.Username, got.User.Username)
+	}
+	want := []containerDecision{
+		{Name: "init", Type: "init", Image: "registry.example.com/init:1.0", Result: containerFailed, Reason: errs[0].Error(), ReasonClass: reasonUnsigned},
+		{
+			Name: "app", Type: "regular", Image: "registry.example.com/app:1.0", Digest: digest.DigestStr(), Result: containerVerified,
+			Policy: "ClusterImagePolicy myorg", KeyFingerprint: "SHA256:9b1f", Format: "bundle",
+		},
+		{
+			Name: "sidecar", Type: "regular", Image: "registry.example.com/sidecar:1.0", Digest: digest.DigestStr(), Result: containerVerified,
+			Identity: "builder@example.com", Issuer: ".*", Format: "legacy",
+		},
+	}
+	if len(got.Containers) != len(want) {
+		t.Fatalf("expected %d containers, got %d", len(want), len(got.Containers))
+	}
+	for i := range want {
+		if got.Containers[i] != want[i] {
+			t.Errorf("container %d = %+v, want %+v", i, got.Containers[i], want[i])
+		}
+	}
+
+	// a disabled decision log is ignored
+	newDecisionLog(nil).write(d)
+}
+
+func TestOpenDecisionLog(t *testing.T) {
+	if w, err := OpenDecisionLog("", 1, 1); err != nil || w != os.Stdout {
+		t.Errorf("expected stdout for empty path, got %v, %v", w, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	w, err := OpenDecisionLog(path, 1, 1)
+	if err != nil {
+		t.Fatalf("OpenDecisionLog() error = %v", err)
+	}
+	newDecisionLog(w).write(&decision{UID: "6f1c", Result: decisionAllowed})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading decision log: %v", err)
+	}
+	if !strings.Contains(string(b), `"uid":"6f1c"`) {
+		t.Errorf("expected decision in log file, got %s", b)
+	}
+}
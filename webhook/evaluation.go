@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/gookit/slog"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v3/pkg/policy"
+)
+
+// validatePolicy makes sure the policy is of a supported type and not empty, what names its owner in errors
+func validatePolicy(what string, p *v1alpha1.Policy) error {
+	if p.Type != "cue" && p.Type != "rego" {
+		return fmt.Errorf("%s has unsupported policy type %q, supported are cue and rego", what, p.Type)
+	}
+	if p.Data == "" {
+		return fmt.Errorf("%s has an empty policy", what)
+	}
+	return nil
+}
+
+// objectMetadata is the metadata of the pod or its namespace passed to the policies
+type objectMetadata struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// evaluationContext holds the admitted pod and its namespace, it's the same for all containers of the pod
+type evaluationContext struct {
+	Pod       objectMetadata `json:"pod"`
+	Namespace objectMetadata `json:"namespace"`
+}
+
+// newEvaluationContext returns the evaluation context of the admitted pod
+func newEvaluationContext(pod *admittedPod, ns namespaceConfig) *evaluationContext {
+	return &evaluationContext{
+		Pod: objectMetadata{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Namespace: objectMetadata{
+			Name:   ns.name,
+			Labels: ns.labels,
+		},
+	}
+}
+
+// evaluationInput is the document the policy of an image policy is evaluated against
+type evaluationInput struct {
+	// Image is the verified image digest
+	Image string `json:"image"`
+	// Annotations of the verified signatures
+	Annotations map[string]any `json:"annotations"`
+	// Attestations are the in-toto statements of the required attestations by attestation name
+	Attestations map[string]any `json:"attestations"`
+	*evaluationContext
+}
+
+// evaluate evaluates the policy of the group against the annotations of a verified signature, the verified
+// attestations and the evaluation context of the pod. The annotations of the signatures aren't merged,
+// the policy must be satisfied by the annotations of one of them.
+func (g *authorityGroup) evaluate(ctx context.Context, digest name.Digest, annotations []map[string]any, attestations map[string]any, ec *evaluationContext) error {
+	if g.evaluation == nil {
+		return nil
+	}
+	if ec == nil {
+		ec = &evaluationContext{}
+	}
+	if len(annotations) == 0 {
+		annotations = []map[string]any{nil}
+	}
+	if attestations == nil {
+		attestations = map[string]any{}
+	}
+	var err error
+	for _, a := range annotations {
+		in := evaluationInput{
+			Image:             digest.String(),
+			Annotations:       a,
+			Attestations:      attestations,
+			evaluationContext: ec,
+		}
+		if in.Annotations == nil {
+			in.Annotations = map[string]any{}
+		}
+		b, merr := json.Marshal(in)
+		if merr != nil {
+			return fmt.Errorf("could not encode policy input: %w", merr)
+		}
+		if _, err = policy.EvaluatePolicyAgainstJSON(ctx, g.policy, g.evaluation.Type, g.evaluation.Data, b); err == nil {
+			log.Debugf("Image %q satisfies the policy", digest.String())
+			return nil
+		}
+		log.Debugf("Policy input of image %q: %s", digest.String(), b)
+	}
+	return fmt.Errorf("image %q doesn't satisfy the policy: %w", digest.String(), err)
+}
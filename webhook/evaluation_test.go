@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testRegoProdPolicy = `package sigstore
+
+default isCompliant = false
+
+isCompliant {
+	input.namespace.labels.stage != "prod"
+}
+
+isCompliant {
+	input.namespace.labels.stage == "prod"
+	input.annotations.env == "prod"
+}`
+
+const testRegoTeamPolicy = `package sigstore
+
+default isCompliant = false
+
+isCompliant {
+	input.annotations.env == "prod"
+	input.annotations.team == "shop"
+}`
+
+func Test_validatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  v1alpha1.Policy
+		wantErr bool
+	}{
+		{name: "cue", policy: v1alpha1.Policy{Type: "cue", Data: `annotations: env: "prod"`}},
+		{name: "rego", policy: v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy}},
+		{name: "unsupported type", policy: v1alpha1.Policy{Type: "cel", Data: `annotations.env == "prod"`}, wantErr: true},
+		{name: "empty", policy: v1alpha1.Policy{Type: "cue"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePolicy("spec", &tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("validatePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_authorityGroup_evaluate(t *testing.T) {
+	digest, err := name.NewDigest("registry.example.com/app@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+	pod := &admittedPod{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "app",
+		Namespace: "shop",
+		Labels:    map[string]string{"app": "shop"},
+	}}}
+	prod := newEvaluationContext(pod, namespaceConfig{name: "shop", labels: map[string]string{"stage": "prod"}})
+	dev := newEvaluationContext(pod, namespaceConfig{name: "shop", labels: map[string]string{"stage": "dev"}})
+	provenance := map[string]any{
+		"provenance": map[string]any{
+			"predicate": map[string]any{"builder": map[string]any{"id": "https://github.com/myorg/builder"}},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		policy       *v1alpha1.Policy
+		annotations  []map[string]any
+		attestations map[string]any
+		ec           *evaluationContext
+		wantErr      bool
+	}{
+		{
+			name: "no policy",
+			ec:   prod,
+		},
+		{
+			name:        "rego annotation required in prod namespace",
+			policy:      &v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy},
+			annotations: []map[string]any{{"env": "prod"}},
+			ec:          prod,
+		},
+		{
+			name:        "rego annotation mismatch in prod namespace",
+			policy:      &v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy},
+			annotations: []map[string]any{{"env": "dev"}},
+			ec:          prod,
+			wantErr:     true,
+		},
+		{
+			name:   "rego annotation not required in dev namespace",
+			policy: &v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy},
+			ec:     dev,
+		},
+		{
+			name:   "cue pod metadata",
+			policy: &v1alpha1.Policy{Type: "cue", Data: `pod: labels: app: "shop"`},
+			ec:     dev,
+		},
+		{
+			name:         "cue attestation",
+			policy:       &v1alpha1.Policy{Type: "cue", Data: `attestations: provenance: predicate: builder: id: "https://github.com/myorg/builder"`},
+			attestations: provenance,
+			ec:           prod,
+		},
+		{
+			name:         "cue attestation mismatch",
+			policy:       &v1alpha1.Policy{Type: "cue", Data: `attestations: provenance: predicate: builder: id: "https://github.com/other/builder"`},
+			attestations: provenance,
+			ec:           prod,
+			wantErr:      true,
+		},
+		{
+			name:    "rego annotation missing",
+			policy:  &v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy},
+			ec:      prod,
+			wantErr: true,
+		},
+		{
+			name:        "rego annotation of one of the signatures",
+			policy:      &v1alpha1.Policy{Type: "rego", Data: testRegoProdPolicy},
+			annotations: []map[string]any{{"env": "dev"}, {"env": "prod"}},
+			ec:          prod,
+		},
+		{
+			name:        "rego annotations of different signatures aren't merged",
+			policy:      &v1alpha1.Policy{Type: "rego", Data: testRegoTeamPolicy},
+			annotations: []map[string]any{{"env": "prod"}, {"team": "shop"}},
+			wantErr:     true,
+		},
+		{
+			name:        "rego annotations of a single signature",
+			policy:      &v1alpha1.Policy{Type: "rego", Data: testRegoTeamPolicy},
+			annotations: []map[string]any{{"env": "prod"}, {"env": "prod", "team": "shop"}},
+		},
+		{
+			name:   "cue image digest",
+			policy: &v1alpha1.Policy{Type: "cue", Data: `image: =~"^registry.example.com/app@sha256:"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &authorityGroup{policy: "ClusterImagePolicy test", evaluation: tt.policy}
+			if err := g.evaluate(t.Context(), digest, tt.annotations, tt.attestations, tt.ec); (err != nil) != tt.wantErr {
+				t.Errorf("evaluate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
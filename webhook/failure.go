@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// containerFailure is the reason a container failed verification
+type containerFailure struct {
+	podContainer
+	reason string
+}
+
+// String returns the container, its image and the reason it failed
+func (f *containerFailure) String() string {
+	return fmt.Sprintf("container %q (image %q): %s", f.container.Name, f.container.Image, f.reason)
+}
+
+// failureMessage returns the denial message enumerating all failed containers
+func failureMessage(failures []containerFailure) string {
+	msgs := make([]string, 0, len(failures))
+	for i := range failures {
+		msgs = append(msgs, failures[i].String())
+	}
+	return fmt.Sprintf("verification failed for %d container(s): %s", len(failures), strings.Join(msgs, "; "))
+}
+
+// failureDetails returns the failed containers as machine-readable causes,
+// with the field of the container's image in the admitted object.
+func failureDetails(pod *admittedPod, failures []containerFailure) *metav1.StatusDetails {
+	details := &metav1.StatusDetails{Name: pod.Name}
+	if gvk := pod.object.GetObjectKind().GroupVersionKind(); !gvk.Empty() {
+		details.Group = gvk.Group
+		details.Kind = gvk.Kind
+	}
+	for _, f := range failures {
+		details.Causes = append(details.Causes, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: f.reason,
+			Field:   fieldPath(f.path + "/image"),
+		})
+	}
+	return details
+}
+
+// fieldPath converts a JSON pointer into a field path, e.g. /spec/containers/0/image into spec.containers[0].image
+func fieldPath(pointer string) string {
+	var b strings.Builder
+	for _, p := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if _, err := strconv.Atoi(p); err == nil {
+			b.WriteString("[" + p + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
@@ -0,0 +1,22 @@
+package webhook
+
+import "testing"
+
+func Test_fieldPath(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    string
+	}{
+		{pointer: "/spec/containers/0/image", want: "spec.containers[0].image"},
+		{pointer: "/spec/initContainers/12/image", want: "spec.initContainers[12].image"},
+		{pointer: "/spec/jobTemplate/spec/template/spec/ephemeralContainers/1/image", want: "spec.jobTemplate.spec.template.spec.ephemeralContainers[1].image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pointer, func(t *testing.T) {
+			if got := fieldPath(tt.pointer); got != tt.want {
+				t.Errorf("fieldPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
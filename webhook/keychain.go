@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// keychainCacheSize is the maximum number of cached registry keychains
+	keychainCacheSize = 1000
+	// keychainTTL is the time a keychain is reused, unless its service account or pull secrets change before
+	keychainTTL = time.Hour
+)
+
+// keychainKey identifies the keychain shared by the pods with the same service account and pull secrets
+type keychainKey struct {
+	namespace      string
+	serviceAccount string
+	// pullSecrets are the sorted names of the pod's image pull secrets
+	pullSecrets string
+}
+
+func newKeychainKey(pod *corev1.Pod) keychainKey {
+	names := make([]string, 0, len(pod.Spec.ImagePullSecrets))
+	for _, s := range pod.Spec.ImagePullSecrets {
+		names = append(names, s.Name)
+	}
+	slices.Sort(names)
+	sa := pod.Spec.ServiceAccountName
+	if sa == "" {
+		sa = "default"
+	}
+	return keychainKey{namespace: pod.Namespace, serviceAccount: sa, pullSecrets: strings.Join(names, ",")}
+}
+
+// keychainCache reuses the registry keychains of pods, instead of reading their service account and
+// pull secrets for every admission. Keychains are dropped once their service account, or a pull secret
+// of their namespace, changes.
+type keychainCache struct {
+	cs        kubernetes.Interface
+	keychains *utilcache.LRUExpireCache
+	synced    cache.InformerSynced
+	// generation is increased with every invalidation, keychains built meanwhile aren't cached
+	generation atomic.Uint64
+}
+
+// newKeychainCache watches the service accounts and Secrets of all namespaces with the informers of the factory,
+// see watchSecrets
+func newKeychainCache(cs kubernetes.Interface, factory informers.SharedInformerFactory) (*keychainCache, error) {
+	kcc := &keychainCache{cs: cs, keychains: utilcache.NewLRUExpireCache(keychainCacheSize)}
+
+	sas := factory.Core().V1().ServiceAccounts().Informer()
+	sasReg, err := sas.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    kcc.forgetServiceAccount,
+		UpdateFunc: func(_, obj any) { kcc.forgetServiceAccount(obj) },
+		DeleteFunc: kcc.forgetServiceAccount,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not add service account event handler: %w", err)
+	}
+
+	secretsReg, err := factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    kcc.forgetPullSecret,
+		UpdateFunc: func(_, obj any) { kcc.forgetPullSecret(obj) },
+		DeleteFunc: kcc.forgetPullSecret,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not add secret event handler: %w", err)
+	}
+
+	// the keychains are used once the initial events are handled
+	kcc.synced = func() bool { return sasReg.HasSynced() && secretsReg.HasSynced() }
+	return kcc, nil
+}
+
+// get returns the cached keychain of the pod, or builds it
+func (kcc *keychainCache) get(ctx context.Context, pod *corev1.Pod) (authn.Keychain, error) {
+	key := newKeychainKey(pod)
+	if kc, ok := kcc.keychains.Get(key); ok {
+		return kc.(authn.Keychain), nil
+	}
+	generation := kcc.generation.Load()
+	kc, err := newKeychainForPod(ctx, pod, kcc.cs)
+	if err != nil {
+		return nil, err
+	}
+	if kcc.generation.Load() == generation {
+		kcc.keychains.Add(key, kc, keychainTTL)
+	}
+	return kc, nil
+}
+
+// forget drops the keychains matching the predicate
+func (kcc *keychainCache) forget(match func(keychainKey) bool) {
+	kcc.generation.Add(1)
+	kcc.keychains.RemoveAll(func(key any) bool {
+		return match(key.(keychainKey))
+	})
+}
+
+// forgetServiceAccount drops the keychains of the changed or deleted service account
+func (kcc *keychainCache) forgetServiceAccount(obj any) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	sa, ok := obj.(*corev1.ServiceAccount)
+	if !ok {
+		return
+	}
+	kcc.forget(func(k keychainKey) bool {
+		return k.namespace == sa.Namespace && k.serviceAccount == sa.Name
+	})
+}
+
+// forgetPullSecret drops the keychains of the namespace of the changed or deleted pull secret.
+// Other Secrets aren't read by the keychains.
+func (kcc *keychainCache) forgetPullSecret(obj any) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	s, ok := obj.(*corev1.Secret)
+	if !ok || (s.Type != corev1.SecretTypeDockerConfigJson && s.Type != corev1.SecretTypeDockercfg) {
+		return
+	}
+	kcc.forget(func(k keychainKey) bool {
+		return k.namespace == s.Namespace
+	})
+}
+
+// keychainFor returns the registry keychain of the pod, from the cache once it's synced
+func (csh *CosignServerHandler) keychainFor(ctx context.Context, pod *corev1.Pod) (authn.Keychain, error) {
+	if csh.keychains != nil && csh.keychains.synced() {
+		return csh.keychains.get(ctx, pod)
+	}
+	return newKeychainForPod(ctx, pod, csh.cs)
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_newKeychainKey(t *testing.T) {
+	pod := func(sa string, pullSecrets ...string) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shop"},
+			Spec:       corev1.PodSpec{ServiceAccountName: sa},
+		}
+		for _, s := range pullSecrets {
+			p.Spec.ImagePullSecrets = append(p.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: s})
+		}
+		return p
+	}
+
+	if newKeychainKey(pod("", "a")) != newKeychainKey(pod("default", "a")) {
+		t.Error("expected pods without service account to share the keychain of the default service account")
+	}
+	if newKeychainKey(pod("app", "a", "b")) != newKeychainKey(pod("app", "b", "a")) {
+		t.Error("expected the order of pull secrets not to matter")
+	}
+	if newKeychainKey(pod("app", "a")) == newKeychainKey(pod("app", "a", "b")) {
+		t.Error("expected pods with other pull secrets not to share the keychain")
+	}
+	if newKeychainKey(pod("app")) == newKeychainKey(pod("other")) {
+		t.Error("expected pods with other service accounts not to share the keychain")
+	}
+}
+
+func TestKeychainCache(t *testing.T) {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "app", Namespace: "shop"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+	}
+	pullSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "shop"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	}
+	cs := fake.NewSimpleClientset(sa, pullSecret)
+	_, kcc, err := watchSecrets(cs, Config{KeychainCache: true}, t.Context().Done())
+	if err != nil {
+		t.Fatalf("watchSecrets() error = %v", err)
+	}
+	if !cache.WaitForCacheSync(t.Context().Done(), kcc.synced) {
+		t.Fatal("service accounts and secrets not synced")
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "shop"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "app"},
+	}
+	builds := func() int {
+		n := 0
+		for _, a := range cs.Actions() {
+			if a.GetVerb() == "get" && a.GetResource().Resource == "serviceaccounts" {
+				n++
+			}
+		}
+		return n
+	}
+	get := func() {
+		t.Helper()
+		if _, err := kcc.get(t.Context(), pod); err != nil {
+			t.Fatalf("get() error = %v", err)
+		}
+	}
+
+	// the replicas of a workload share the keychain
+	get()
+	get()
+	if n := builds(); n != 1 {
+		t.Fatalf("expected keychain to be built once, got %d", n)
+	}
+
+	// other secrets aren't read by the keychains
+	kcc.forgetPullSecret(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "shop"}, Type: corev1.SecretTypeOpaque})
+	get()
+	if n := builds(); n != 1 {
+		t.Errorf("expected keychain to be kept for an opaque secret, got %d builds", n)
+	}
+
+	// a changed pull secret drops the keychains of the namespace
+	kcc.forgetPullSecret(cache.DeletedFinalStateUnknown{Key: "shop/registry", Obj: pullSecret})
+	get()
+	if n := builds(); n != 2 {
+		t.Errorf("expected keychain to be built again for a deleted pull secret, got %d builds", n)
+	}
+
+	// a changed service account drops its keychains
+	updated := sa.DeepCopy()
+	updated.ImagePullSecrets = nil
+	if _, err := cs.CoreV1().ServiceAccounts("shop").Update(t.Context(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed updating service account: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(kcc.keychains.Keys()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("keychain of the updated service account not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	get()
+	if n := builds(); n != 3 {
+		t.Errorf("expected keychain to be built again for an updated service account, got %d builds", n)
+	}
+}
@@ -0,0 +1,152 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/gookit/slog"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/cosign/v3/pkg/oci"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	CosignIdentityEnvVar       = "COSIGN_CERTIFICATE_IDENTITY"
+	CosignIdentityRegExpEnvVar = "COSIGN_CERTIFICATE_IDENTITY_REGEXP"
+	CosignIssuerEnvVar         = "COSIGN_CERTIFICATE_OIDC_ISSUER"
+	CosignIssuerRegExpEnvVar   = "COSIGN_CERTIFICATE_OIDC_ISSUER_REGEXP"
+)
+
+// authority describes what the signature of a container is verified against:
+// either a static public key or the identity of a keyless (Fulcio) certificate.
+type authority struct {
+	pubKey string
+	// secret is the Secret the public key was read from, nil if not read from a Secret
+	secret *secretVersion
+	// algorithm is the signature algorithm of the public key, derived from the key if empty
+	algorithm string
+	identity  *cosign.Identity
+	// tlog requires the signature to be logged in the Rekor transparency log
+	tlog bool
+	// annotations are required on the signatures
+	annotations map[string]any
+	// policy is the image policy declaring the authority, empty if taken from the container or namespace
+	policy string
+	// namespaced is set for the authorities of an ImagePolicy
+	namespaced bool
+	// threshold is the number of authorities of the same policy, or of the container,
+	// which must verify the signatures. 0 is treated like 1.
+	threshold int
+	// attestations of the policy are required once the signatures are verified
+	attestations []v1alpha1.Attestation
+	// evaluation is the policy evaluated once the signatures and attestations are verified
+	evaluation *v1alpha1.Policy
+}
+
+// getIdentityFor searches for the keyless identity to verify the container's signature.
+// Like the public key, it's read from the container's environment or the default secret
+// of the namespace. If no identity is found, it returns nil.
+func (csh *CosignServerHandler) getIdentityFor(c *corev1.Container, ns string) *cosign.Identity {
+	if c.Image == "" {
+		return nil
+	}
+	if id := getIdentityFromEnv(c.Env); id != nil {
+		log.Debugf("Found keyless identity in env vars for container %q", c.Name)
+		return id
+	}
+
+	if !csh.useDefaultSecret(ns) {
+		return nil
+	}
+	data, err := csh.getSecretData(ns, "cosignwebhook")
+	if err != nil {
+		log.Debugf("Could not find keyless identity in default secret: %v", err)
+		return nil
+	}
+	id := &cosign.Identity{
+		Subject:       string(data[CosignIdentityEnvVar]),
+		SubjectRegExp: string(data[CosignIdentityRegExpEnvVar]),
+		Issuer:        string(data[CosignIssuerEnvVar]),
+		IssuerRegExp:  string(data[CosignIssuerRegExpEnvVar]),
+	}
+	if *id == (cosign.Identity{}) {
+		return nil
+	}
+	log.Debugf("Found keyless identity in default secret for container %q", c.Name)
+	return id
+}
+
+// getIdentityFromEnv returns the keyless identity configured in the passed env vars,
+// or nil if none of the identity env vars is set.
+func getIdentityFromEnv(env []corev1.EnvVar) *cosign.Identity {
+	id := cosign.Identity{}
+	for _, e := range env {
+		switch e.Name {
+		case CosignIdentityEnvVar:
+			id.Subject = e.Value
+		case CosignIdentityRegExpEnvVar:
+			id.SubjectRegExp = e.Value
+		case CosignIssuerEnvVar:
+			id.Issuer = e.Value
+		case CosignIssuerRegExpEnvVar:
+			id.IssuerRegExp = e.Value
+		}
+	}
+	if id == (cosign.Identity{}) {
+		return nil
+	}
+	return &id
+}
+
+// validateIdentity makes sure both the certificate subject and the issuer are constrained.
+// Accepting any subject or any issuer would allow every Fulcio user to sign images.
+func validateIdentity(id *cosign.Identity) error {
+	if id.Subject == "" && id.SubjectRegExp == "" {
+		return fmt.Errorf("keyless verification requires %s or %s", CosignIdentityEnvVar, CosignIdentityRegExpEnvVar)
+	}
+	if id.Issuer == "" && id.IssuerRegExp == "" {
+		return fmt.Errorf("keyless verification requires %s or %s", CosignIssuerEnvVar, CosignIssuerRegExpEnvVar)
+	}
+	return nil
+}
+
+// oidcIssuerOIDs are the Fulcio certificate extensions holding the OIDC issuer, deprecated and current
+var oidcIssuerOIDs = []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 57264, 1, 1}, {1, 3, 6, 1, 4, 1, 57264, 1, 8}}
+
+// certSigners returns the identity of the certificate of each keyless signature.
+// Signatures without a certificate, e.g. of a key, are skipped.
+func certSigners(sigs []oci.Signature) []string {
+	var signers []string
+	for _, sig := range sigs {
+		cert, err := sig.Cert()
+		if err != nil || cert == nil {
+			continue
+		}
+		signers = append(signers, certSigner(cert))
+	}
+	return signers
+}
+
+// certSigner identifies the party of a Fulcio certificate by its subject alternative names and OIDC issuer.
+// Certificates issued to the same identity at different times have the same signer.
+func certSigner(cert *x509.Certificate) string {
+	h := sha256.New()
+	for _, san := range cryptoutils.GetSubjectAlternateNames(cert) {
+		h.Write([]byte("san\x00" + san + "\x00"))
+	}
+	for _, ext := range cert.Extensions {
+		for _, oid := range oidcIssuerOIDs {
+			if ext.Id.Equal(oid) {
+				h.Write([]byte("issuer\x00"))
+				h.Write(ext.Value)
+			}
+		}
+	}
+	return "keyless:" + hex.EncodeToString(h.Sum(nil))
+}
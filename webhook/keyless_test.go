@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	cbundle "github.com/sigstore/cosign/v3/pkg/cosign/bundle"
+	"github.com/sigstore/cosign/v3/pkg/oci/static"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCosignServerHandler_getIdentityFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		container     *corev1.Container
+		secretPresent bool
+		want          *cosign.Identity
+	}{
+		{
+			name: "identity from environment variables",
+			container: &corev1.Container{
+				Image: "busybox",
+				Env: []corev1.EnvVar{
+					{Name: CosignIdentityEnvVar, Value: "dev@example.com"},
+					{Name: CosignIssuerEnvVar, Value: "https://accounts.example.com"},
+				},
+			},
+			want: &cosign.Identity{Subject: "dev@example.com", Issuer: "https://accounts.example.com"},
+		},
+		{
+			name: "identity regexp from environment variables",
+			container: &corev1.Container{
+				Image: "busybox",
+				Env: []corev1.EnvVar{
+					{Name: CosignIdentityRegExpEnvVar, Value: ".*@example.com"},
+					{Name: CosignIssuerEnvVar, Value: "https://accounts.example.com"},
+				},
+			},
+			want: &cosign.Identity{SubjectRegExp: ".*@example.com", Issuer: "https://accounts.example.com"},
+		},
+		{
+			name: "identity from default secret",
+			container: &corev1.Container{
+				Image: "busybox",
+				Env:   []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+			},
+			secretPresent: true,
+			want:          &cosign.Identity{Subject: "ns@example.com", Issuer: "https://ns.example.com"},
+		},
+		{
+			name: "no identity",
+			container: &corev1.Container{
+				Image: "busybox",
+				Env:   []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+			},
+		},
+		{
+			name: "identity from default secret without env vars",
+			container: &corev1.Container{
+				Image: "busybox",
+			},
+			secretPresent: true,
+			want:          &cosign.Identity{Subject: "ns@example.com", Issuer: "https://ns.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			if tt.secretPresent {
+				c = fake.NewSimpleClientset(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "cosignwebhook",
+						Namespace: "test",
+					},
+					Data: map[string][]byte{
+						CosignIdentityEnvVar: []byte("ns@example.com"),
+						CosignIssuerEnvVar:   []byte("https://ns.example.com"),
+					},
+				})
+			}
+			csh := &CosignServerHandler{cs: c}
+
+			got := csh.getIdentityFor(tt.container, "test")
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("getIdentityFor() got = %v, want %v", got, tt.want)
+			}
+			if got != nil && *got != *tt.want {
+				t.Errorf("getIdentityFor() got = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_buildCheckOpts_expiredCertificate(t *testing.T) {
+	rootCert, rootKey := testCACert(t, "fulcio", nil, nil)
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating rekor key: %v", err)
+	}
+	trustRoot, err := newTrustedRoot(testCertsPEM(t, rootCert), testPubKeyPEM(t, &rekorKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaf certificate expired 10 minutes after signing, like the ones issued by Fulcio
+	signedAt := time.Now().Add(-30 * time.Minute)
+	leafCert, leafKey := testFulcioCert(t, "dev@example.com", "https://accounts.example.com", signedAt, rootCert, rootKey)
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"registry.example.com/app"}}}`)
+	digest := sha256.Sum256(payload)
+	rawSig, err := ecdsa.SignASN1(rand.Reader, leafKey, digest[:])
+	if err != nil {
+		t.Fatalf("failed signing payload: %v", err)
+	}
+	b64Sig := base64.StdEncoding.EncodeToString(rawSig)
+	certPEM := testCertsPEM(t, leafCert)
+
+	csh := &CosignServerHandler{trustRoot: trustRoot}
+	co, err := csh.buildCheckOpts(t.Context(), "registry.example.com/app", &authority{
+		identity: &cosign.Identity{Subject: "dev@example.com", Issuer: "https://accounts.example.com"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("buildCheckOpts() error = %v", err)
+	}
+
+	// the log entry proves the signature was created while the certificate was valid
+	rb := testRekorBundle(t, rekorKey, b64Sig, certPEM, digest[:], signedAt.Add(time.Minute))
+	sig, err := static.NewSignature(payload, b64Sig, static.WithCertChain(certPEM, testCertsPEM(t, rootCert)), static.WithBundle(rb))
+	if err != nil {
+		t.Fatalf("failed creating signature: %v", err)
+	}
+	if _, err := cosign.VerifyImageSignature(t.Context(), sig, v1.Hash{}, co); err != nil {
+		t.Errorf("expected expired certificate with log entry to be verified, got %v", err)
+	}
+
+	unlogged, err := static.NewSignature(payload, b64Sig, static.WithCertChain(certPEM, testCertsPEM(t, rootCert)))
+	if err != nil {
+		t.Fatalf("failed creating signature: %v", err)
+	}
+	if _, err := cosign.VerifyImageSignature(t.Context(), unlogged, v1.Hash{}, co); err == nil {
+		t.Error("expected expired certificate without log entry to be rejected")
+	}
+}
+
+// testFulcioCert issues a code signing certificate for the identity, valid for 10 minutes from notBefore
+func testFulcioCert(t testing.TB, email, issuer string, notBefore time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating ECDSA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		NotBefore:      notBefore,
+		NotAfter:       notBefore.Add(10 * time.Minute),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{email},
+		// the OIDC issuer extension of Fulcio
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}, Value: []byte(issuer)}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing certificate: %v", err)
+	}
+	return cert, key
+}
+
+// testRekorBundle creates the hashedrekord log entry of the signature, with the signed entry timestamp of the log
+func testRekorBundle(t testing.TB, rekorKey *ecdsa.PrivateKey, b64Sig string, certPEM, digest []byte, integratedTime time.Time) *cbundle.RekorBundle {
+	body, err := json.Marshal(map[string]any{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]any{
+			"signature": map[string]any{
+				"content":   b64Sig,
+				"publicKey": map[string]any{"content": base64.StdEncoding.EncodeToString(certPEM)},
+			},
+			"data": map[string]any{"hash": map[string]any{"algorithm": "sha256", "value": hex.EncodeToString(digest)}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed encoding log entry: %v", err)
+	}
+	logID, err := cosign.GetTransparencyLogID(&rekorKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed computing log id: %v", err)
+	}
+	payload := cbundle.RekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: integratedTime.Unix(),
+		LogIndex:       1,
+		LogID:          logID,
+	}
+	// the keys of the canonical JSON are sorted, like the ones of a marshaled map
+	canonical, err := json.Marshal(map[string]any{
+		"body":           payload.Body,
+		"integratedTime": payload.IntegratedTime,
+		"logIndex":       payload.LogIndex,
+		"logID":          payload.LogID,
+	})
+	if err != nil {
+		t.Fatalf("failed encoding log payload: %v", err)
+	}
+	sum := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, rekorKey, sum[:])
+	if err != nil {
+		t.Fatalf("failed signing log entry: %v", err)
+	}
+	return &cbundle.RekorBundle{SignedEntryTimestamp: set, Payload: payload}
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/gookit/slog"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature/kms"
+	"github.com/sigstore/sigstore/pkg/signature/options"
+	"k8s.io/apimachinery/pkg/util/cache"
+
+	// register the KMS providers
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/aws"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/azure"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/gcp"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/hashivault"
+)
+
+const (
+	// kmsKeyCacheSize is the maximum number of cached KMS public keys
+	kmsKeyCacheSize = 100
+	// kmsKeyTTL is the time a KMS public key is cached before it's fetched again
+	kmsKeyTTL = 10 * time.Minute
+)
+
+// kmsSchemes are the prefixes of the supported KMS key references
+var kmsSchemes = []string{"awskms://", "gcpkms://", "azurekms://", "hashivault://"}
+
+// isKMSRef reports whether the key is a KMS key reference instead of a PEM encoded public key
+func isKMSRef(key string) bool {
+	key = strings.TrimSpace(key)
+	for _, s := range kmsSchemes {
+		if strings.HasPrefix(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// kmsKeys fetches the public keys of KMS key references and caches them,
+// so the KMS isn't queried for every admission request.
+type kmsKeys struct {
+	keys *cache.LRUExpireCache
+}
+
+func newKMSKeys() *kmsKeys {
+	return &kmsKeys{keys: cache.NewLRUExpireCache(kmsKeyCacheSize)}
+}
+
+// publicKey returns the PEM encoded public key of the KMS key reference.
+// Keys are fetched with the credentials of the webhook, e.g. from its environment or workload identity.
+func (k *kmsKeys) publicKey(ctx context.Context, ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if k != nil {
+		if v, ok := k.keys.Get(ref); ok {
+			return v.(string), nil
+		}
+	}
+
+	// the hash function is only used for signing, the public key doesn't depend on it
+	sv, err := kms.Get(ctx, ref, crypto.SHA256)
+	if err != nil {
+		log.Errorf("Error loading KMS key %q: %v", ref, err)
+		return "", fmt.Errorf("could not load KMS key %q: %w", ref, err)
+	}
+	pub, err := sv.PublicKey(options.WithContext(ctx))
+	if err != nil {
+		log.Errorf("Error fetching public key of KMS key %q: %v", ref, err)
+		return "", fmt.Errorf("could not fetch public key of KMS key %q: %w", ref, err)
+	}
+	pem, err := cryptoutils.MarshalPublicKeyToPEM(pub)
+	if err != nil {
+		return "", fmt.Errorf("could not encode public key of KMS key %q: %w", ref, err)
+	}
+
+	if k != nil {
+		k.keys.Add(ref, string(pem), kmsKeyTTL)
+	}
+	log.Debugf("Fetched public key of KMS key %q", ref)
+	return string(pem), nil
+}
@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_isKMSRef(t *testing.T) {
+	for key, want := range map[string]bool{
+		"awskms:///arn:aws:kms:eu-central-1:123456789012:key/cosign": true,
+		"gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k":    true,
+		"azurekms://vault.vault.azure.net/cosign":                    true,
+		" hashivault://cosign\n":                                     true,
+		"-----BEGIN PUBLIC KEY-----":                                 false,
+		"k8s://cosignwebhook/cosign":                                 false,
+	} {
+		if got := isKMSRef(key); got != want {
+			t.Errorf("isKMSRef(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func Test_kmsKeys_publicKey(t *testing.T) {
+	pubKey := string(testPubKeyPEM(t, testECDSAPubKey(t)))
+
+	// stand-in for the transit secrets engine of a Vault dev server
+	requests := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transit/keys/cosign" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"latest_version": 1,
+				"keys": map[string]any{
+					"1": map[string]any{"name": "P-256", "public_key": pubKey},
+				},
+			},
+		})
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "test")
+
+	k := newKMSKeys()
+	for range 2 {
+		got, err := k.publicKey(t.Context(), "hashivault://cosign")
+		if err != nil {
+			t.Fatalf("publicKey() error = %v", err)
+		}
+		if got != pubKey {
+			t.Errorf("publicKey() got = %q, want %q", got, pubKey)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected public key to be fetched once, got %d requests", requests)
+	}
+
+	if _, err := k.publicKey(t.Context(), "hashivault://missing"); err == nil {
+		t.Error("expected error for missing key")
+	}
+}
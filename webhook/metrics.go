@@ -0,0 +1,143 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherLabel replaces the label values beyond the configured limit
+const otherLabel = "other"
+
+// failure reason classes of the container verifications
+const (
+	// reasonUnsigned is a container without public key, keyless identity or image policy in enforce mode
+	reasonUnsigned = "unsigned"
+	// reasonConfig is an invalid key, identity, policy or setting
+	reasonConfig = "config"
+	// reasonReference is an image reference which can't be parsed
+	reasonReference = "reference"
+	// reasonRegistry is an image whose digest can't be resolved
+	reasonRegistry    = "registry"
+	reasonSignature   = "signature"
+	reasonTlog        = "tlog"
+	reasonAnnotations = "annotations"
+	reasonAttestation = "attestation"
+	reasonPolicy      = "policy"
+	// reasonThreshold is an image verified by fewer authorities than required
+	reasonThreshold = "threshold"
+	reasonOther     = "other"
+)
+
+var (
+	admissionsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cosign_admissions_total",
+		Help: "The number of admissions by namespace, result (allowed, denied, warned, skipped or error) and endpoint",
+	}, []string{"namespace", "result", "endpoint"})
+	containersProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cosign_container_verifications_total",
+		Help: "The number of verified containers by namespace, result, signature format, failure reason and endpoint",
+	}, []string{"namespace", "result", "format", "reason", "endpoint"})
+	admissionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cosign_admission_duration_seconds",
+		Help:    "The time from receiving an admission request until it's answered, by result and endpoint",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"result", "endpoint"})
+	registryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cosign_registry_request_duration_seconds",
+		Help:    "The duration of the requests to the registries, by registry and status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry", "code"})
+)
+
+// reasonError classifies a verification error for the metrics
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e *reasonError) Error() string { return e.err.Error() }
+
+func (e *reasonError) Unwrap() error { return e.err }
+
+// withReason classifies the error, nil stays nil
+func withReason(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &reasonError{reason: reason, err: err}
+}
+
+// failureReason returns the outermost reason class of the error
+func failureReason(err error) string {
+	var re *reasonError
+	if errors.As(err, &re) {
+		return re.reason
+	}
+	return reasonOther
+}
+
+// labelLimiter bounds the cardinality of a label: the first max values seen are kept, later ones are
+// replaced by otherLabel. A nil limiter keeps all values.
+type labelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(limit int) *labelLimiter {
+	return &labelLimiter{max: limit, seen: map[string]struct{}{}}
+}
+
+// value returns the label value to record for v
+func (l *labelLimiter) value(v string) string {
+	if l == nil {
+		return v
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		return otherLabel
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
+
+// observeDecision records the metrics of the admission, labelled with the endpoint reviewing it
+func (csh *CosignServerHandler) observeDecision(d *decision) {
+	ns := csh.namespaceLabels.value(d.Namespace)
+	result := d.Result
+	if result == decisionAllowed && !d.verified() {
+		result = containerSkipped
+	}
+	admissionsProcessed.WithLabelValues(ns, result, d.Endpoint).Inc()
+	admissionDuration.WithLabelValues(result, d.Endpoint).Observe(d.LatencySeconds)
+	for _, c := range d.Containers {
+		containersProcessed.WithLabelValues(ns, c.Result, c.Format, c.ReasonClass, d.Endpoint).Inc()
+	}
+}
+
+// registryTransport records the duration of the registry requests
+type registryTransport struct {
+	next       http.RoundTripper
+	registries *labelLimiter
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	registryDuration.WithLabelValues(t.registries.value(req.URL.Host), code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_failureReason(t *testing.T) {
+	g := &authorityGroup{policy: "ClusterImagePolicy test"}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "unclassified", err: errors.New("boom"), want: reasonOther},
+		{name: "classified", err: withReason(reasonSignature, errors.New("no matching signatures")), want: reasonSignature},
+		{name: "wrapped by policy", err: g.wrap(withReason(reasonPolicy, errors.New("not compliant"))), want: reasonPolicy},
+		{
+			name: "outermost class",
+			err:  withReason(reasonAttestation, withReason(reasonConfig, errors.New("public key malformed"))),
+			want: reasonAttestation,
+		},
+		{
+			name: "first of joined",
+			err:  errors.Join(withReason(reasonTlog, errors.New("missing entry")), withReason(reasonSignature, errors.New("no signatures"))),
+			want: reasonTlog,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if withReason(reasonConfig, nil) != nil {
+		t.Error("expected nil error to stay nil")
+	}
+}
+
+func Test_labelLimiter(t *testing.T) {
+	l := newLabelLimiter(2)
+	for _, v := range []string{"a", "b", "a"} {
+		if got := l.value(v); got != v {
+			t.Errorf("value(%q) = %q, want %q", v, got, v)
+		}
+	}
+	if got := l.value("c"); got != otherLabel {
+		t.Errorf("expected values beyond the limit to be %q, got %q", otherLabel, got)
+	}
+	var unlimited *labelLimiter
+	if got := unlimited.value("c"); got != "c" {
+		t.Errorf("expected nil limiter to keep the value, got %q", got)
+	}
+}
+
+func TestCosignServerHandler_observeDecision(t *testing.T) {
+	csh := &CosignServerHandler{namespaceLabels: newLabelLimiter(1)}
+	before := func(ns, result, endpoint string) float64 {
+		return testutil.ToFloat64(admissionsProcessed.WithLabelValues(ns, result, endpoint))
+	}
+	allowed, skipped, other := before("metrics", decisionAllowed, "validate"), before("metrics", containerSkipped, "validate"), before(otherLabel, decisionDenied, "validate")
+	mutated := before("metrics", decisionAllowed, "mutate")
+	failed := testutil.ToFloat64(containersProcessed.WithLabelValues("metrics", containerFailed, "", reasonSignature, "validate"))
+
+	csh.observeDecision(&decision{Endpoint: "validate", Namespace: "metrics", Result: decisionAllowed, Containers: []containerDecision{
+		{Result: containerVerified, Format: "bundle"},
+	}})
+	csh.observeDecision(&decision{Endpoint: "validate", Namespace: "metrics", Result: decisionAllowed, Containers: []containerDecision{
+		{Result: containerSkipped},
+	}})
+	// the namespace is beyond the limit
+	csh.observeDecision(&decision{Endpoint: "validate", Namespace: "metrics-other", Result: decisionDenied, Containers: []containerDecision{
+		{Result: containerFailed, ReasonClass: reasonSignature},
+	}})
+	csh.observeDecision(&decision{Endpoint: "validate", Namespace: "metrics", Result: decisionDenied, Containers: []containerDecision{
+		{Result: containerFailed, ReasonClass: reasonSignature},
+	}})
+	// the same admission reviewed by the mutating webhook
+	csh.observeDecision(&decision{Endpoint: "mutate", Namespace: "metrics", Result: decisionAllowed, Containers: []containerDecision{
+		{Result: containerVerified, Format: "bundle"},
+	}})
+
+	if got := before("metrics", decisionAllowed, "validate") - allowed; got != 1 {
+		t.Errorf("expected 1 allowed admission, got %v", got)
+	}
+	if got := before("metrics", decisionAllowed, "mutate") - mutated; got != 1 {
+		t.Errorf("expected 1 allowed admission by the mutating webhook, got %v", got)
+	}
+	if got := before("metrics", containerSkipped, "validate") - skipped; got != 1 {
+		t.Errorf("expected admission without verified containers to be skipped, got %v", got)
+	}
+	if got := before(otherLabel, decisionDenied, "validate") - other; got != 1 {
+		t.Errorf("expected namespace beyond the limit to be recorded as %q, got %v", otherLabel, got)
+	}
+	if got := testutil.ToFloat64(containersProcessed.WithLabelValues("metrics", containerFailed, "", reasonSignature, "validate")) - failed; got != 1 {
+		t.Errorf("expected 1 failed container, got %v", got)
+	}
+}
+
+func Test_registryTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	rt := &registryTransport{next: http.DefaultTransport, registries: newLabelLimiter(1)}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/v2/", http.NoBody)
+	if err != nil {
+		t.Fatalf("failed creating request: %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	_ = resp.Body.Close()
+
+	m := &dto.Metric{}
+	observer := registryDuration.WithLabelValues(req.URL.Host, strconv.Itoa(http.StatusUnauthorized))
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("failed reading histogram: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("expected 1 request to %s, got %d", req.URL.Host, got)
+	}
+}
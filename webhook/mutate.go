@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/gookit/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// patchOperation is a JSONPatch operation returned by /mutate
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// pinImage returns the operation replacing the image at path with the verified digest,
+// or nil if the image is already referenced by that digest.
+// Pinning the image makes sure the kubelet pulls the digest that was verified, even if the tag is moved.
+func pinImage(path, image string, digest name.Digest) *patchOperation {
+	if ref, err := name.ParseReference(image); err == nil {
+		if d, ok := ref.(name.Digest); ok && d.DigestStr() == digest.DigestStr() {
+			return nil
+		}
+	}
+	pinned := fmt.Sprintf("%s@%s", digest.Context().Name(), digest.DigestStr())
+	log.Debugf("Pinning image %q to %q", image, pinned)
+	return &patchOperation{Op: "replace", Path: path, Value: pinned}
+}
+
+// pinnable reports whether the image of the container may be pinned by the request.
+// Changing the image of a running container restarts it, so only the containers created by the request are pinned:
+// all containers of a created pod, and the ephemeral containers added by an update of the ephemeralcontainers subresource.
+func pinnable(req *v1.AdmissionRequest, pc *podContainer) bool {
+	switch {
+	case req.Operation == v1.Create:
+		return true
+	case req.Operation != v1.Update || req.SubResource != "ephemeralcontainers" || pc.kind != "ephemeral":
+		return false
+	}
+	old := &corev1.Pod{}
+	if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+		log.Errorf("Can't decode old pod, not pinning ephemeral container %s: %v", pc.container.Name, err)
+		return false
+	}
+	for _, c := range old.Spec.EphemeralContainers {
+		if c.Name == pc.container.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// mutate allows the container to start with its images pinned by the passed patch
+func mutate(w http.ResponseWriter, msg string, patch []patchOperation, uid types.UID) {
+	p, err := json.Marshal(patch)
+	if err != nil {
+		log.Errorf("Can't encode patch: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode patch: %v", err), http.StatusInternalServerError)
+		return
+	}
+	ar := admissionReview(http.StatusOK, true, "Success", msg, uid)
+	pt := v1.PatchTypeJSONPatch
+	ar.Response.Patch = p
+	ar.Response.PatchType = &pt
+	resp, err := json.Marshal(ar)
+	if err != nil {
+		log.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func Test_pinImage(t *testing.T) {
+	const sha = "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+	tests := []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{
+			name:  "tag",
+			image: "ghcr.io/myorg/app:1.0",
+			want:  "ghcr.io/myorg/app@" + sha,
+		},
+		{
+			name:  "docker hub short name",
+			image: "busybox",
+			want:  "index.docker.io/library/busybox@" + sha,
+		},
+		{
+			name:  "already pinned",
+			image: "ghcr.io/myorg/app@" + sha,
+		},
+		{
+			name:  "tag and digest",
+			image: "ghcr.io/myorg/app:1.0@" + sha,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.image)
+			if err != nil {
+				t.Fatalf("failed parsing image: %v", err)
+			}
+			digest := ref.Context().Digest(sha)
+
+			op := pinImage("/spec/containers/0/image", tt.image, digest)
+			if tt.want == "" {
+				if op != nil {
+					t.Errorf("expected no patch, got %+v", *op)
+				}
+				return
+			}
+			if op == nil {
+				t.Fatalf("expected patch to %q, got none", tt.want)
+			}
+			if op.Op != "replace" || op.Path != "/spec/containers/0/image" || op.Value != tt.want {
+				t.Errorf("expected replacing image with %q, got %+v", tt.want, *op)
+			}
+		})
+	}
+}
+
+func Test_pinnable(t *testing.T) {
+	old, err := json.Marshal(&corev1.Pod{Spec: corev1.PodSpec{
+		Containers:          []corev1.Container{{Name: "app"}},
+		EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug"}}},
+	}})
+	if err != nil {
+		t.Fatalf("failed encoding pod: %v", err)
+	}
+	tests := []struct {
+		name string
+		req  v1.AdmissionRequest
+		pc   podContainer
+		want bool
+	}{
+		{
+			name: "container of created pod",
+			req:  v1.AdmissionRequest{Operation: v1.Create},
+			pc:   podContainer{container: corev1.Container{Name: "app"}, kind: "regular"},
+			want: true,
+		},
+		{
+			name: "container of updated pod",
+			req:  v1.AdmissionRequest{Operation: v1.Update, OldObject: runtime.RawExtension{Raw: old}},
+			pc:   podContainer{container: corev1.Container{Name: "app"}, kind: "regular"},
+		},
+		{
+			name: "added ephemeral container",
+			req:  v1.AdmissionRequest{Operation: v1.Update, SubResource: "ephemeralcontainers", OldObject: runtime.RawExtension{Raw: old}},
+			pc:   podContainer{container: corev1.Container{Name: "debug-2"}, kind: "ephemeral"},
+			want: true,
+		},
+		{
+			name: "running ephemeral container",
+			req:  v1.AdmissionRequest{Operation: v1.Update, SubResource: "ephemeralcontainers", OldObject: runtime.RawExtension{Raw: old}},
+			pc:   podContainer{container: corev1.Container{Name: "debug"}, kind: "ephemeral"},
+		},
+		{
+			name: "regular container on ephemeral container update",
+			req:  v1.AdmissionRequest{Operation: v1.Update, SubResource: "ephemeralcontainers", OldObject: runtime.RawExtension{Raw: old}},
+			pc:   podContainer{container: corev1.Container{Name: "app"}, kind: "regular"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pinnable(&tt.req, &tt.pc); got != tt.want {
+				t.Errorf("pinnable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
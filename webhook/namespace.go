@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"context"
+	"strconv"
+
+	log "github.com/gookit/slog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// TlogLabel enables ("true") or disables ("false") transparency log verification for a namespace,
+	// overriding the global setting.
+	TlogLabel = "cosignwebhook/tlog"
+	// EnforceLabel enables ("true") or disables ("false") the enforce mode for a namespace,
+	// overriding the global setting.
+	EnforceLabel = "cosignwebhook/enforce"
+	// WarnLabel enables ("true") or disables ("false") the warn mode for a namespace,
+	// overriding the global setting.
+	WarnLabel = "cosignwebhook/warn"
+)
+
+// namespaceConfig holds the verification settings for the pods of a namespace
+type namespaceConfig struct {
+	name string
+	tlog bool
+	// enforce denies pods with containers no authority was found for
+	enforce bool
+	// warn admits pods failing verification with a warning instead of denying them
+	warn bool
+	// labels of the namespace, passed to the policies
+	labels map[string]string
+}
+
+// getNamespaceConfig returns the verification settings of the namespace.
+// Labels on the namespace override the global settings of the handler.
+func (csh *CosignServerHandler) getNamespaceConfig(ns string) namespaceConfig {
+	cfg := namespaceConfig{
+		name:    ns,
+		tlog:    csh.requireTlog,
+		enforce: csh.enforce,
+		warn:    csh.warn,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	defer cancel()
+	n, err := csh.cs.CoreV1().Namespaces().Get(ctx, ns, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("Can't get namespace %s, using global settings: %v", ns, err)
+		return cfg
+	}
+
+	cfg.tlog = boolLabel(n.Labels, TlogLabel, cfg.tlog)
+	cfg.enforce = boolLabel(n.Labels, EnforceLabel, cfg.enforce)
+	cfg.warn = boolLabel(n.Labels, WarnLabel, cfg.warn)
+	cfg.labels = n.Labels
+	return cfg
+}
+
+// boolLabel returns the boolean value of the label, or the default if the label is missing or invalid
+func boolLabel(labels map[string]string, key string, def bool) bool {
+	v, ok := labels[key]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Invalid value %q for label %s, using default %t", v, key, def)
+		return def
+	}
+	return b
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCosignServerHandler_getNamespaceConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		nsPresent   bool
+		requireTlog bool
+		enforce     bool
+		warn        bool
+		want        namespaceConfig
+	}{
+		{
+			name:      "no labels",
+			nsPresent: true,
+			want:      namespaceConfig{name: "test"},
+		},
+		{
+			name:        "global tlog setting",
+			nsPresent:   true,
+			requireTlog: true,
+			want:        namespaceConfig{name: "test", tlog: true},
+		},
+		{
+			name:      "tlog enabled by label",
+			labels:    map[string]string{TlogLabel: "true"},
+			nsPresent: true,
+			want:      namespaceConfig{name: "test", tlog: true},
+		},
+		{
+			name:        "tlog disabled by label",
+			labels:      map[string]string{TlogLabel: "false"},
+			nsPresent:   true,
+			requireTlog: true,
+			want:        namespaceConfig{name: "test"},
+		},
+		{
+			name:        "invalid label value",
+			labels:      map[string]string{TlogLabel: "maybe"},
+			nsPresent:   true,
+			requireTlog: true,
+			want:        namespaceConfig{name: "test", tlog: true},
+		},
+		{
+			name:      "enforce enabled by label",
+			labels:    map[string]string{EnforceLabel: "true"},
+			nsPresent: true,
+			want:      namespaceConfig{name: "test", enforce: true},
+		},
+		{
+			name:      "enforce disabled by label",
+			labels:    map[string]string{EnforceLabel: "false"},
+			nsPresent: true,
+			enforce:   true,
+			want:      namespaceConfig{name: "test"},
+		},
+		{
+			name:      "global enforce setting",
+			nsPresent: true,
+			enforce:   true,
+			want:      namespaceConfig{name: "test", enforce: true},
+		},
+		{
+			name:      "warn enabled by label",
+			labels:    map[string]string{WarnLabel: "true"},
+			nsPresent: true,
+			want:      namespaceConfig{name: "test", warn: true},
+		},
+		{
+			name:      "warn disabled by label",
+			labels:    map[string]string{WarnLabel: "false"},
+			nsPresent: true,
+			warn:      true,
+			want:      namespaceConfig{name: "test"},
+		},
+		{
+			name:        "namespace not found",
+			requireTlog: true,
+			want:        namespaceConfig{name: "test", tlog: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			if tt.nsPresent {
+				c = fake.NewSimpleClientset(&corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "test",
+						Labels: tt.labels,
+					},
+				})
+			}
+			csh := &CosignServerHandler{
+				cs:          c,
+				requireTlog: tt.requireTlog,
+				enforce:     tt.enforce,
+				warn:        tt.warn,
+			}
+
+			tt.want.labels = tt.labels
+			if got := csh.getNamespaceConfig("test"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getNamespaceConfig() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
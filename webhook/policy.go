@@ -0,0 +1,372 @@
+package webhook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/gookit/slog"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// invalidPolicies flags the image policies whose current version is invalid, a ClusterImagePolicy by name
+// and an ImagePolicy by namespace/name. A previously valid version stays in effect.
+var invalidPolicies = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cosign_invalid_image_policies",
+	Help: "Image policies whose current version is invalid, set to 1 until they're fixed or deleted",
+}, []string{"policy"})
+
+// imagePolicy is a parsed image policy with compiled image patterns
+type imagePolicy struct {
+	name string
+	// namespace of an ImagePolicy, empty for a ClusterImagePolicy
+	namespace   string
+	patterns    []*regexp.Regexp
+	authorities []v1alpha1.Authority
+	// threshold is the number of authorities required to verify the signatures, or thresholdAll
+	threshold int
+	// annotations are required on the signatures
+	annotations map[string]any
+	// attestations are required in addition to the signatures
+	attestations []v1alpha1.Attestation
+	// evaluation is the policy evaluated once the signatures and attestations are verified
+	evaluation *v1alpha1.Policy
+}
+
+// String returns the kind and name of the policy, as reported in the admission response
+func (p *imagePolicy) String() string {
+	if p.namespace == "" {
+		return "ClusterImagePolicy " + p.name
+	}
+	return "ImagePolicy " + p.namespace + "/" + p.name
+}
+
+// policyStore keeps the image policies up to date with the cluster
+type policyStore struct {
+	mu sync.RWMutex
+	// policies are keyed by namespace/name, or by name for a ClusterImagePolicy
+	policies map[string]*imagePolicy
+	synced   cache.InformerSynced
+}
+
+func newPolicyStore() *policyStore {
+	return &policyStore{
+		policies: map[string]*imagePolicy{},
+		synced:   func() bool { return true },
+	}
+}
+
+// watch starts the informers for the ClusterImagePolicies and the ImagePolicies
+func (ps *policyStore) watch(dc dynamic.Interface, stop <-chan struct{}) error {
+	var synced []cache.InformerSynced
+	for _, gvr := range []schema.GroupVersionResource{v1alpha1.ClusterImagePolicyResource, v1alpha1.ImagePolicyResource} {
+		inf := dynamicinformer.NewFilteredDynamicInformer(dc, gvr, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+		_, err := inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    ps.set,
+			UpdateFunc: func(_, obj any) { ps.set(obj) },
+			DeleteFunc: ps.remove,
+		})
+		if err != nil {
+			return fmt.Errorf("could not add %s event handler: %w", gvr.Resource, err)
+		}
+		synced = append(synced, inf.HasSynced)
+		go inf.Run(stop)
+	}
+	ps.synced = func() bool {
+		for _, s := range synced {
+			if !s() {
+				return false
+			}
+		}
+		return true
+	}
+	return nil
+}
+
+// set parses the policy and adds it to the store, replacing an older version.
+// An invalid update keeps the last valid version, so a broken edit doesn't remove the enforcement.
+func (ps *policyStore) set(obj any) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	// both kinds share the spec, the namespace tells them apart
+	ip := &v1alpha1.ImagePolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, ip); err != nil {
+		log.Errorf("Can't convert image policy %s: %v", policyKey(u), err)
+		return
+	}
+	p, err := newImagePolicy(ip.Namespace, ip.Name, &ip.Spec)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err != nil {
+		invalidPolicies.WithLabelValues(policyKey(u)).Set(1)
+		if _, ok := ps.policies[policyKey(u)]; ok {
+			log.Errorf("Ignoring invalid update of image policy %s, keeping the last valid version: %v", policyKey(u), err)
+			return
+		}
+		log.Errorf("Ignoring invalid image policy %s: %v", policyKey(u), err)
+		return
+	}
+	ps.policies[policyKey(u)] = p
+	invalidPolicies.DeleteLabelValues(policyKey(u))
+	log.Infof("%s loaded", p)
+}
+
+// remove deletes the policy from the store
+func (ps *policyStore) remove(obj any) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.policies, policyKey(u))
+	invalidPolicies.DeleteLabelValues(policyKey(u))
+	log.Infof("Image policy %s removed", policyKey(u))
+}
+
+// policyKey returns the key of the policy in the store
+func policyKey(u *unstructured.Unstructured) string {
+	if u.GetNamespace() == "" {
+		return u.GetName()
+	}
+	return u.GetNamespace() + "/" + u.GetName()
+}
+
+// matching returns the policies applying to the image in the namespace: the ClusterImagePolicies,
+// then the ImagePolicies of the namespace, each sorted by name. The image must be verified by both kinds,
+// so an ImagePolicy can't override the ClusterImagePolicies.
+func (ps *policyStore) matching(image, ns string) []*imagePolicy {
+	names := []string{image}
+	if ref, err := name.ParseReference(image); err == nil && ref.Name() != image {
+		names = append(names, ref.Name())
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var namespaced, cluster []*imagePolicy
+	for _, p := range ps.policies {
+		switch {
+		case p.namespace == "" && p.matches(names):
+			cluster = append(cluster, p)
+		case p.namespace == ns && p.matches(names):
+			namespaced = append(namespaced, p)
+		}
+	}
+	sort.Slice(cluster, func(i, j int) bool { return cluster[i].name < cluster[j].name })
+	sort.Slice(namespaced, func(i, j int) bool { return namespaced[i].name < namespaced[j].name })
+	return append(cluster, namespaced...)
+}
+
+// hasNamespaced reports whether the namespace has at least one ImagePolicy
+func (ps *policyStore) hasNamespaced(ns string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, p := range ps.policies {
+		if p.namespace == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// useDefaultSecret reports whether the implicit cosignwebhook Secret of the namespace is consulted.
+// It's replaced by the ImagePolicies, so it's ignored once the namespace has one.
+func (csh *CosignServerHandler) useDefaultSecret(ns string) bool {
+	return csh.policies == nil || !csh.policies.hasNamespaced(ns)
+}
+
+// newImagePolicy validates the policy spec and compiles its image patterns
+func newImagePolicy(namespace, policyName string, spec *v1alpha1.ImagePolicySpec) (*imagePolicy, error) {
+	if len(spec.Images) == 0 {
+		return nil, fmt.Errorf("no images declared")
+	}
+	if len(spec.Authorities) == 0 {
+		return nil, fmt.Errorf("no authorities declared")
+	}
+	threshold, err := parseThreshold(spec.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range spec.Attestations {
+		if err := validateAttestation(&a); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Policy != nil {
+		if err := validatePolicy("spec", spec.Policy); err != nil {
+			return nil, err
+		}
+	}
+	p := &imagePolicy{
+		name:         policyName,
+		namespace:    namespace,
+		authorities:  spec.Authorities,
+		threshold:    threshold,
+		attestations: spec.Attestations,
+		evaluation:   spec.Policy,
+	}
+	if len(spec.Annotations) > 0 {
+		p.annotations = make(map[string]any, len(spec.Annotations))
+		for k, v := range spec.Annotations {
+			p.annotations[k] = v
+		}
+	}
+	for _, img := range spec.Images {
+		re, err := globToRegexp(img.Glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image glob %q: %w", img.Glob, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// matches reports whether one of the image names matches a pattern of the policy
+func (p *imagePolicy) matches(names []string) bool {
+	for _, re := range p.patterns {
+		for _, n := range names {
+			if re.MatchString(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globToRegexp converts an image glob into an anchored regular expression.
+// '*' and '?' don't match the path separator, '**' matches anything.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("empty glob")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// getPolicyAuthoritiesFor returns the authorities of all policies applying to the image in the namespace.
+// Keys referenced in Secrets are resolved, an error is returned if one can't be read or the
+// threshold of a policy exceeds its authorities.
+func (csh *CosignServerHandler) getPolicyAuthoritiesFor(image, ns string) ([]*authority, error) {
+	if csh.policies == nil {
+		return nil, nil
+	}
+	var auths []*authority
+	for _, p := range csh.policies.matching(image, ns) {
+		log.Debugf("Image %q matches %s", image, p)
+		var policyAuths []*authority
+		for i := range p.authorities {
+			a, err := csh.resolveAuthority(p, &p.authorities[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			policyAuths = append(policyAuths, a...)
+		}
+		policyAuths, err := withThreshold(policyAuths, p.threshold)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		auths = append(auths, policyAuths...)
+	}
+	return auths, nil
+}
+
+// resolveAuthority converts the authority of a policy into the authorities to verify against
+func (csh *CosignServerHandler) resolveAuthority(p *imagePolicy, a *v1alpha1.Authority) ([]*authority, error) {
+	var auths []*authority
+	if a.Key != nil {
+		pubKey := a.Key.Data
+		var secret *secretVersion
+		if a.Key.KMS != "" {
+			if !isKMSRef(a.Key.KMS) {
+				return nil, fmt.Errorf("KMS key of authority %q must start with one of %s", a.Name, strings.Join(kmsSchemes, ", "))
+			}
+			pubKey = a.Key.KMS
+		}
+		if ref := a.Key.SecretRef; ref != nil {
+			// an ImagePolicy must not read Secrets of other namespaces
+			ns := ref.Namespace
+			if p.namespace != "" {
+				ns = p.namespace
+			}
+			var err error
+			pubKey, secret, err = csh.getSecretValue(ns, ref.Name, ref.Key)
+			if err != nil {
+				return nil, fmt.Errorf("can't read key of authority %q from secret %s/%s: %w", a.Name, ns, ref.Name, err)
+			}
+		}
+		if pubKey == "" {
+			return nil, fmt.Errorf("key of authority %q is empty", a.Name)
+		}
+		for _, k := range splitPublicKeys(pubKey) {
+			auths = append(auths, &authority{
+				pubKey:       k,
+				secret:       secret,
+				algorithm:    a.Key.Algorithm,
+				annotations:  p.annotations,
+				policy:       p.String(),
+				namespaced:   p.namespace != "",
+				attestations: p.attestations,
+				evaluation:   p.evaluation,
+			})
+		}
+	}
+	if a.Keyless != nil {
+		for _, id := range a.Keyless.Identities {
+			auths = append(auths, &authority{
+				identity: &cosign.Identity{
+					Subject:       id.Subject,
+					SubjectRegExp: id.SubjectRegExp,
+					Issuer:        id.Issuer,
+					IssuerRegExp:  id.IssuerRegExp,
+				},
+				annotations:  p.annotations,
+				policy:       p.String(),
+				namespaced:   p.namespace != "",
+				attestations: p.attestations,
+				evaluation:   p.evaluation,
+			})
+		}
+	}
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("authority %q has neither a key nor keyless identities", a.Name)
+	}
+	return auths, nil
+}
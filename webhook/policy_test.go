@@ -0,0 +1,339 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_globToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		image   string
+		want    bool
+		wantErr bool
+	}{
+		{glob: "ghcr.io/myorg/**", image: "ghcr.io/myorg/app:1.0", want: true},
+		{glob: "ghcr.io/myorg/**", image: "ghcr.io/myorg/team/app@sha256:abc", want: true},
+		{glob: "ghcr.io/myorg/**", image: "ghcr.io/otherorg/app:1.0"},
+		{glob: "ghcr.io/myorg/*", image: "ghcr.io/myorg/app:1.0", want: true},
+		{glob: "ghcr.io/myorg/*", image: "ghcr.io/myorg/team/app:1.0"},
+		{glob: "ghcr.io/myorg/app:?.0", image: "ghcr.io/myorg/app:1.0", want: true},
+		{glob: "ghcr.io/myorg/app", image: "ghcr.io/myorg/app:1.0"},
+		{glob: "ghcr.io/my.org/**", image: "ghcr.io/myxorg/app"},
+		{glob: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.image, func(t *testing.T) {
+			re, err := globToRegexp(tt.glob)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("globToRegexp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := re.MatchString(tt.image); got != tt.want {
+				t.Errorf("glob %q matching %q = %t, want %t", tt.glob, tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_policyStore(t *testing.T) {
+	ps := newPolicyStore()
+	ps.set(testClusterImagePolicy(t, "myorg", "ghcr.io/myorg/**"))
+	ps.set(testClusterImagePolicy(t, "dockerhub", "index.docker.io/library/*"))
+	ps.set(testClusterImagePolicy(t, "all", "**"))
+	ps.set(testClusterImagePolicy(t, "invalid", ""))
+
+	names := func(ps []*imagePolicy) []string {
+		n := []string{}
+		for _, p := range ps {
+			n = append(n, p.name)
+		}
+		return n
+	}
+
+	if got := names(ps.matching("ghcr.io/myorg/app:1.0", "test")); len(got) != 2 || got[0] != "all" || got[1] != "myorg" {
+		t.Errorf("expected policies [all myorg], got %v", got)
+	}
+	if got := names(ps.matching("busybox", "test")); len(got) != 2 || got[0] != "all" || got[1] != "dockerhub" {
+		t.Errorf("expected policies [all dockerhub], got %v", got)
+	}
+
+	ps.remove(testClusterImagePolicy(t, "all", "**"))
+	if got := names(ps.matching("quay.io/foo/bar", "test")); len(got) != 0 {
+		t.Errorf("expected no policies, got %v", got)
+	}
+
+	// updating a policy with an invalid spec keeps the last valid version
+	ps.set(testClusterImagePolicy(t, "myorg", ""))
+	if got := names(ps.matching("ghcr.io/myorg/app:1.0", "test")); len(got) != 1 || got[0] != "myorg" {
+		t.Errorf("expected policies [myorg], got %v", got)
+	}
+	if got := testutil.ToFloat64(invalidPolicies.WithLabelValues("myorg")); got != 1 {
+		t.Errorf("expected invalid policy to be flagged, got %v", got)
+	}
+	if got := testutil.ToFloat64(invalidPolicies.WithLabelValues("invalid")); got != 1 {
+		t.Errorf("expected invalid new policy to be flagged, got %v", got)
+	}
+	ps.remove(testClusterImagePolicy(t, "myorg", ""))
+	if got := names(ps.matching("ghcr.io/myorg/app:1.0", "test")); len(got) != 0 {
+		t.Errorf("expected no policies, got %v", got)
+	}
+
+	// ImagePolicies of the namespace apply in addition to the ClusterImagePolicies
+	ps.set(testClusterImagePolicy(t, "myorg", "ghcr.io/myorg/**"))
+	ps.set(testImagePolicy(t, "test", "team", "ghcr.io/myorg/team/*"))
+	ps.set(testImagePolicy(t, "test", "all", "**"))
+	ps.set(testImagePolicy(t, "other", "team", "ghcr.io/myorg/**"))
+	if got := names(ps.matching("ghcr.io/myorg/team/app:1.0", "test")); len(got) != 3 || got[0] != "myorg" || got[1] != "all" || got[2] != "team" {
+		t.Errorf("expected policies [myorg all team], got %v", got)
+	}
+	if got := ps.matching("ghcr.io/myorg/team/app:1.0", "test"); got[2].String() != "ImagePolicy test/team" {
+		t.Errorf("expected ImagePolicy test/team, got %s", got[2])
+	}
+	if got := names(ps.matching("ghcr.io/myorg/app:1.0", "test")); len(got) != 2 || got[0] != "myorg" || got[1] != "all" {
+		t.Errorf("expected policies [myorg all], got %v", got)
+	}
+	if !ps.hasNamespaced("test") || ps.hasNamespaced("default") {
+		t.Errorf("expected ImagePolicies in namespace test only")
+	}
+	ps.remove(testImagePolicy(t, "test", "all", ""))
+
+	ps.remove(testImagePolicy(t, "test", "team", ""))
+	if got := names(ps.matching("ghcr.io/myorg/team/app:1.0", "test")); len(got) != 1 || got[0] != "myorg" {
+		t.Errorf("expected policies [myorg], got %v", got)
+	}
+	if got := names(ps.matching("ghcr.io/myorg/team/app:1.0", "other")); len(got) != 2 || got[0] != "myorg" || got[1] != "team" {
+		t.Errorf("expected policies [myorg team], got %v", got)
+	}
+}
+
+func TestCosignServerHandler_getAuthoritiesFor(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "policy-key",
+			Namespace: "cosignwebhook",
+		},
+		Data: map[string][]byte{
+			CosignEnvVar: []byte("secret key"),
+		},
+	}
+	tenantSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "policy-key",
+			Namespace: "tenant",
+		},
+		Data: map[string][]byte{
+			CosignEnvVar: []byte("tenant key"),
+		},
+	}
+	defaultSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cosignwebhook",
+			Namespace: "tenant",
+		},
+		Data: map[string][]byte{
+			CosignEnvVar: []byte("default key"),
+		},
+	}
+	ps := newPolicyStore()
+	ps.set(testImagePolicy(t, "tenant", "team", "ghcr.io/myorg/team/**"))
+	ps.set(testClusterImagePolicy(t, "myorg", "ghcr.io/myorg/**"))
+	ps.set(testPolicyObject(t, &v1alpha1.ClusterImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing-secret"},
+		Spec: v1alpha1.ImagePolicySpec{
+			Images: []v1alpha1.ImagePattern{{Glob: "ghcr.io/broken/**"}},
+			Authorities: []v1alpha1.Authority{
+				{Key: &v1alpha1.Key{SecretRef: &v1alpha1.SecretKeyRef{Namespace: "cosignwebhook", Name: "missing", Key: CosignEnvVar}}},
+			},
+		},
+	}))
+
+	ps.set(testPolicyObject(t, &v1alpha1.ClusterImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "too-strict"},
+		Spec: v1alpha1.ImagePolicySpec{
+			Images:      []v1alpha1.ImagePattern{{Glob: "ghcr.io/strict/**"}},
+			Authorities: []v1alpha1.Authority{{Key: &v1alpha1.Key{Data: "inline key"}}},
+			Threshold:   "2",
+		},
+	}))
+
+	envKey := []corev1.EnvVar{{Name: CosignEnvVar, Value: "env key"}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		image     string
+		env       []corev1.EnvVar
+		wantKeys  []string
+		wantIDs   int
+		// wantAnnotations are expected on every authority
+		wantAnnotations map[string]any
+		wantErr         bool
+	}{
+		{
+			name:     "policy takes precedence over env",
+			image:    "ghcr.io/myorg/app:1.0",
+			env:      envKey,
+			wantKeys: []string{"inline key", "secret key"},
+			wantIDs:  1,
+		},
+		{
+			name:     "env without matching policy",
+			image:    "ghcr.io/otherorg/app:1.0",
+			env:      envKey,
+			wantKeys: []string{"env key"},
+		},
+		{
+			name:            "env with required annotations",
+			image:           "ghcr.io/otherorg/app:1.0",
+			env:             append([]corev1.EnvVar{{Name: CosignAnnotationsEnvVar, Value: "env=prod"}}, envKey...),
+			wantKeys:        []string{"env key"},
+			wantAnnotations: map[string]any{"env": "prod"},
+		},
+		{
+			name:    "env with invalid annotations",
+			image:   "ghcr.io/otherorg/app:1.0",
+			env:     append([]corev1.EnvVar{{Name: CosignAnnotationsEnvVar, Value: "env"}}, envKey...),
+			wantErr: true,
+		},
+		{
+			name:  "no policy and no env",
+			image: "ghcr.io/otherorg/app:1.0",
+		},
+		{
+			name:      "namespaced policy applies in addition to cluster policy",
+			namespace: "tenant",
+			image:     "ghcr.io/myorg/team/app:1.0",
+			wantKeys:  []string{"inline key", "secret key", "inline key", "tenant key"},
+			wantIDs:   2,
+		},
+		{
+			name:      "cluster policy without matching namespaced policy",
+			namespace: "tenant",
+			image:     "ghcr.io/myorg/app:1.0",
+			wantKeys:  []string{"inline key", "secret key"},
+			wantIDs:   1,
+		},
+		{
+			name:      "default secret ignored in namespace with policy",
+			namespace: "tenant",
+			image:     "ghcr.io/otherorg/app:1.0",
+			env:       []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+		},
+		{
+			name:      "env without matching policy in namespace with policy",
+			namespace: "tenant",
+			image:     "ghcr.io/otherorg/app:1.0",
+			env:       envKey,
+			wantKeys:  []string{"env key"},
+		},
+		{
+			name:    "policy threshold exceeding authorities",
+			image:   "ghcr.io/strict/app:1.0",
+			env:     envKey,
+			wantErr: true,
+		},
+		{
+			name:    "policy with missing secret",
+			image:   "ghcr.io/broken/app:1.0",
+			env:     envKey,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csh := &CosignServerHandler{
+				cs:       fake.NewSimpleClientset(secret, tenantSecret, defaultSecret),
+				policies: ps,
+			}
+			c := corev1.Container{Name: "test", Image: tt.image, Env: tt.env}
+			ns := tt.namespace
+			if ns == "" {
+				ns = "test"
+			}
+
+			got, err := csh.getAuthoritiesFor(c, namespaceConfig{name: ns, tlog: true})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAuthoritiesFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var keys []string
+			ids := 0
+			for _, a := range got {
+				if !a.tlog {
+					t.Errorf("expected tlog setting of namespace on authority %+v", a)
+				}
+				if len(tt.wantKeys) > 1 && a.policy == "" {
+					t.Errorf("expected policy on authority %+v", a)
+				}
+				if !reflect.DeepEqual(a.annotations, tt.wantAnnotations) {
+					t.Errorf("expected annotations %v on authority %+v", tt.wantAnnotations, a)
+				}
+				if a.identity != nil {
+					ids++
+					continue
+				}
+				keys = append(keys, a.pubKey)
+			}
+			if len(keys) != len(tt.wantKeys) || ids != tt.wantIDs {
+				t.Fatalf("getAuthoritiesFor() got keys %v and %d identities, want %v and %d", keys, ids, tt.wantKeys, tt.wantIDs)
+			}
+			for i := range keys {
+				if keys[i] != tt.wantKeys[i] {
+					t.Errorf("getAuthoritiesFor() got keys %v, want %v", keys, tt.wantKeys)
+				}
+			}
+		})
+	}
+}
+
+// testClusterImagePolicy returns a policy with an inline key, a key from a secret and a keyless identity
+func testClusterImagePolicy(t testing.TB, policyName, glob string) *unstructured.Unstructured {
+	return testPolicyObject(t, &v1alpha1.ClusterImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: policyName},
+		Spec: v1alpha1.ImagePolicySpec{
+			Images: []v1alpha1.ImagePattern{{Glob: glob}},
+			Authorities: []v1alpha1.Authority{
+				{Name: "inline", Key: &v1alpha1.Key{Data: "inline key"}},
+				{Name: "secret", Key: &v1alpha1.Key{SecretRef: &v1alpha1.SecretKeyRef{Namespace: "cosignwebhook", Name: "policy-key", Key: CosignEnvVar}}},
+				{Name: "keyless", Keyless: &v1alpha1.Keyless{Identities: []v1alpha1.Identity{{Subject: "dev@example.com", Issuer: "https://accounts.example.com"}}}},
+			},
+		},
+	})
+}
+
+// testImagePolicy returns a namespaced policy with an inline key, a key from a secret and a keyless identity
+func testImagePolicy(t testing.TB, namespace, policyName, glob string) *unstructured.Unstructured {
+	return testPolicyObject(t, &v1alpha1.ImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: policyName, Namespace: namespace},
+		Spec: v1alpha1.ImagePolicySpec{
+			Images: []v1alpha1.ImagePattern{{Glob: glob}},
+			Authorities: []v1alpha1.Authority{
+				{Name: "inline", Key: &v1alpha1.Key{Data: "inline key"}},
+				// the namespace of the secret is ignored for namespaced policies
+				{Name: "secret", Key: &v1alpha1.Key{SecretRef: &v1alpha1.SecretKeyRef{Namespace: "cosignwebhook", Name: "policy-key", Key: CosignEnvVar}}},
+				{Name: "keyless", Keyless: &v1alpha1.Keyless{Identities: []v1alpha1.Identity{{Subject: "dev@example.com", Issuer: "https://accounts.example.com"}}}},
+			},
+		},
+	})
+}
+
+// testPolicyObject converts the policy into the unstructured object passed by the informer
+func testPolicyObject(t testing.TB, policy any) *unstructured.Unstructured {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(policy)
+	if err != nil {
+		t.Fatalf("failed converting policy: %v", err)
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
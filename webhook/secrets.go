@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/gookit/slog"
+
+	"github.com/sigstore/sigstore/pkg/signature"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// secretVersion identifies the version of the Secret a public key was read from
+type secretVersion struct {
+	types.NamespacedName
+	resourceVersion string
+}
+
+func newSecretVersion(s *corev1.Secret) *secretVersion {
+	return &secretVersion{
+		NamespacedName:  types.NamespacedName{Namespace: s.Namespace, Name: s.Name},
+		resourceVersion: s.ResourceVersion,
+	}
+}
+
+// verifierKey identifies the verifier of a public key
+type verifierKey struct {
+	pubKey    string
+	algorithm string
+}
+
+// secretVerifiers are the verifiers parsed from the keys of one version of a Secret
+type secretVerifiers struct {
+	resourceVersion string
+	verifiers       map[verifierKey]signature.Verifier
+}
+
+// secretStore serves the Secrets with keys and settings from an informer cache, so they aren't
+// fetched from the API server for every container of every admission. The verifiers parsed from
+// their public keys are cached by the resourceVersion of the Secret.
+type secretStore struct {
+	lister corelisters.SecretLister
+	synced cache.InformerSynced
+	// selector limits the cached Secrets, the others are got from the API server
+	selector labels.Selector
+
+	mu sync.Mutex
+	// verifiers are keyed by the Secret, they're dropped once it changes
+	verifiers map[types.NamespacedName]*secretVerifiers
+}
+
+// watchSecrets starts the secret store and the keychain cache as configured. They share the informers, so the
+// Secrets of all namespaces are watched once. Only the data of the Secrets matching the label selector of the
+// secret store is kept in memory, the keychain cache only needs the metadata.
+func watchSecrets(cs kubernetes.Interface, cfg Config, stop <-chan struct{}) (*secretStore, *keychainCache, error) {
+	var selector labels.Selector
+	var opts []informers.SharedInformerOption
+	if cfg.SecretCache {
+		var err error
+		if selector, err = labels.Parse(cfg.SecretLabelSelector); err != nil {
+			return nil, nil, fmt.Errorf("invalid secret label selector %q: %w", cfg.SecretLabelSelector, err)
+		}
+		// the API server filters the Secrets, unless the keychain cache watches all of them
+		if !cfg.KeychainCache {
+			opts = append(opts, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+				o.LabelSelector = cfg.SecretLabelSelector
+			}))
+		}
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, opts...)
+	err := factory.Core().V1().Secrets().Informer().SetTransform(func(obj any) (any, error) {
+		if s, ok := obj.(*corev1.Secret); ok {
+			s.ManagedFields = nil
+			if selector == nil || !selector.Matches(labels.Set(s.Labels)) {
+				s.Data, s.StringData = nil, nil
+			}
+		}
+		return obj, nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not strip secret data: %w", err)
+	}
+
+	var ss *secretStore
+	if cfg.SecretCache {
+		if ss, err = newSecretStore(factory, selector); err != nil {
+			return nil, nil, err
+		}
+	}
+	var kcc *keychainCache
+	if cfg.KeychainCache {
+		if kcc, err = newKeychainCache(cs, factory); err != nil {
+			return nil, nil, err
+		}
+	}
+	factory.Start(stop)
+	return ss, kcc, nil
+}
+
+// newSecretStore serves the Secrets matching the label selector from the informer of the factory
+func newSecretStore(factory informers.SharedInformerFactory, selector labels.Selector) (*secretStore, error) {
+	inf := factory.Core().V1().Secrets()
+	ss := &secretStore{
+		lister:    inf.Lister(),
+		synced:    inf.Informer().HasSynced,
+		selector:  selector,
+		verifiers: map[types.NamespacedName]*secretVerifiers{},
+	}
+	_, err := inf.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj any) { ss.forget(obj) },
+		DeleteFunc: ss.forget,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not add secret event handler: %w", err)
+	}
+	return ss, nil
+}
+
+// get returns the cached Secret, it must not be modified. The data of Secrets not matching
+// the label selector isn't cached, they aren't found.
+func (ss *secretStore) get(namespace, name string) (*corev1.Secret, error) {
+	s, err := ss.lister.Secrets(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ss.selector.Matches(labels.Set(s.Labels)) {
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return s, nil
+}
+
+// verifier returns the cached verifier of the public key, if the Secret didn't change since
+func (ss *secretStore) verifier(sv *secretVersion, key verifierKey) (signature.Verifier, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.verifiers[sv.NamespacedName]
+	if !ok || e.resourceVersion != sv.resourceVersion {
+		return nil, false
+	}
+	v, ok := e.verifiers[key]
+	return v, ok
+}
+
+// addVerifier caches the verifier of the public key, replacing the verifiers of older versions of the Secret
+func (ss *secretStore) addVerifier(sv *secretVersion, key verifierKey, v signature.Verifier) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.verifiers[sv.NamespacedName]
+	if !ok || e.resourceVersion != sv.resourceVersion {
+		e = &secretVerifiers{resourceVersion: sv.resourceVersion, verifiers: map[verifierKey]signature.Verifier{}}
+		ss.verifiers[sv.NamespacedName] = e
+	}
+	e.verifiers[key] = v
+}
+
+// forget drops the verifiers of the changed or deleted Secret
+func (ss *secretStore) forget(obj any) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	s, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	ss.mu.Lock()
+	delete(ss.verifiers, types.NamespacedName{Namespace: s.Namespace, Name: s.Name})
+	ss.mu.Unlock()
+}
+
+// getSecret returns the Secret from the cache once it's synced, else from the API server.
+// Secrets not cached because of the label selector are got from the API server as well.
+func (csh *CosignServerHandler) getSecret(namespace, name string) (*corev1.Secret, error) {
+	if csh.secrets != nil && csh.secrets.synced() {
+		s, err := csh.secrets.get(namespace, name)
+		if err == nil {
+			return s, nil
+		}
+		if !apierrors.IsNotFound(err) || csh.secrets.selector.Empty() {
+			log.Debugf("Can't find secret %s/%s in cache: %v", namespace, name, err)
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	defer cancel()
+	s, err := csh.cs.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("Can't get secret %s/%s : %v", namespace, name, err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// verifierFor returns the signature verifier of the public key of the authority.
+// Verifiers of keys read from a Secret are cached until the Secret changes,
+// KMS key references are left to the KMS key cache.
+func (csh *CosignServerHandler) verifierFor(ctx context.Context, image string, auth *authority) (signature.Verifier, error) {
+	cacheable := csh.secrets != nil && auth.secret != nil && !isKMSRef(auth.pubKey)
+	key := verifierKey{pubKey: auth.pubKey, algorithm: auth.algorithm}
+	if cacheable {
+		if v, ok := csh.secrets.verifier(auth.secret, key); ok {
+			return v, nil
+		}
+	}
+	v, err := csh.parseVerifier(ctx, image, auth.pubKey, auth.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		csh.secrets.addVerifier(auth.secret, key, v)
+	}
+	return v, nil
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSecretStore(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "cosignwebhook",
+			Namespace:       "test",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"app": "cosignwebhook"},
+		},
+		Data: map[string][]byte{CosignEnvVar: testPubKeyPEM(t, testECDSAPubKey(t))},
+	}
+	unlabeled := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosignwebhook", Namespace: "other", ResourceVersion: "1"},
+		Data:       map[string][]byte{CosignEnvVar: testPubKeyPEM(t, testECDSAPubKey(t))},
+	}
+	cs := fake.NewSimpleClientset(secret, unlabeled)
+
+	if _, _, err := watchSecrets(cs, Config{SecretCache: true, SecretLabelSelector: "app in ("}, t.Context().Done()); err == nil {
+		t.Error("expected error for invalid label selector")
+	}
+	// the keychain cache shares the informer of the secrets
+	ss, kcc, err := watchSecrets(cs, Config{SecretCache: true, SecretLabelSelector: "app=cosignwebhook", KeychainCache: true}, t.Context().Done())
+	if err != nil {
+		t.Fatalf("watchSecrets() error = %v", err)
+	}
+	if !cache.WaitForCacheSync(t.Context().Done(), ss.synced, kcc.synced) {
+		t.Fatal("secrets not synced")
+	}
+	csh := &CosignServerHandler{cs: cs, secrets: ss}
+
+	pubKey, sv, err := csh.getSecretValue("test", "cosignwebhook", CosignEnvVar)
+	if err != nil {
+		t.Fatalf("getSecretValue() error = %v", err)
+	}
+	if pubKey != string(secret.Data[CosignEnvVar]) || sv == nil || sv.resourceVersion != "1" {
+		t.Fatalf("unexpected public key or secret version %v", sv)
+	}
+	// the data of secrets without matching labels isn't cached, they're got from the API server
+	if s, err := ss.lister.Secrets("other").Get("cosignwebhook"); err != nil || s.Data != nil {
+		t.Errorf("expected only the metadata of the secret without matching labels to be cached, got error %v", err)
+	}
+	if _, err := ss.get("other", "cosignwebhook"); err == nil {
+		t.Error("expected secret without matching labels not to be served from the cache")
+	}
+	if pubKey, sv, err := csh.getSecretValue("other", "cosignwebhook", CosignEnvVar); err != nil || pubKey != string(unlabeled.Data[CosignEnvVar]) || sv == nil {
+		t.Errorf("expected secret without matching labels to be got from the API server, got error %v", err)
+	}
+	if _, _, err := csh.getSecretValue("other", "missing", CosignEnvVar); err == nil {
+		t.Error("expected missing secret not to be found")
+	}
+
+	// the verifier is parsed once per version of the secret
+	auth := &authority{pubKey: pubKey, secret: sv}
+	first, err := csh.verifierFor(t.Context(), "registry.example.com/app", auth)
+	if err != nil {
+		t.Fatalf("verifierFor() error = %v", err)
+	}
+	if again, _ := csh.verifierFor(t.Context(), "registry.example.com/app", auth); again != first {
+		t.Error("expected cached verifier")
+	}
+
+	updated := secret.DeepCopy()
+	updated.ResourceVersion = "2"
+	if _, err := cs.CoreV1().Secrets("test").Update(t.Context(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed updating secret: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, sv, _ = csh.getSecretValue("test", "cosignwebhook", CosignEnvVar); sv != nil && sv.resourceVersion == "2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("updated secret not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, _ := csh.verifierFor(t.Context(), "registry.example.com/app", &authority{pubKey: pubKey, secret: sv}); v == first {
+		t.Error("expected verifier to be parsed again for the updated secret")
+	}
+
+	// verifiers of deleted secrets are dropped
+	ss.forget(cache.DeletedFinalStateUnknown{Key: "test/cosignwebhook", Obj: updated})
+	if _, ok := ss.verifier(sv, verifierKey{pubKey: pubKey}); ok {
+		t.Error("expected verifier of the deleted secret to be dropped")
+	}
+}
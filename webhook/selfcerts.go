@@ -0,0 +1,484 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	log "github.com/gookit/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// caCertKey and caKeyKey hold the CA bundle and the CA key in the certificate Secret,
+	// next to the serving certificate and key in tls.crt and tls.key
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+	// nextCACertKey and nextCAKeyKey hold the new CA while the CA is rotated. It's in the CA bundle already,
+	// but only issues the serving certificate once the bundle is injected into the webhook configurations.
+	nextCACertKey = "next-ca.crt"
+	nextCAKeyKey  = "next-ca.key"
+	// caValidityFactor is the validity of the CA as multiple of the validity of the serving certificate
+	caValidityFactor = 10
+	// certCheckInterval is the interval the leader checks the certificates for rotation
+	certCheckInterval = 10 * time.Minute
+)
+
+// SelfManagedCertsConfig holds the settings of the self-managed webhook certificates
+type SelfManagedCertsConfig struct {
+	// Namespace of the webhook, its Service, the certificate Secret and the Lease
+	Namespace string
+	// Service is the name of the Service of the webhook, the serving certificate is issued for it
+	Service string
+	// Secret is the name of the Secret the CA and serving certificate are stored in
+	Secret string
+	// WebhookConfig is the name of the ValidatingWebhookConfiguration and MutatingWebhookConfiguration,
+	// the CA bundle is injected into all their webhooks
+	WebhookConfig string
+	// Validity of the serving certificate, it's rotated once less than a third of it remains
+	Validity time.Duration
+	// Identity of the replica in the Lease, e.g. the pod name
+	Identity string
+}
+
+// SelfManagedCerts generates the CA and serving certificate of the webhook, stores them in a Secret
+// and injects the CA into the webhook configurations. The replicas coordinate with a Lease, only
+// the leader writes the certificates, all replicas serve the certificate of the Secret.
+type SelfManagedCerts struct {
+	servingCert
+	cs  kubernetes.Interface
+	cfg SelfManagedCertsConfig
+}
+
+// NewSelfManagedCerts creates the self-managed certificates with the in-cluster client
+func NewSelfManagedCerts(cfg SelfManagedCertsConfig) (*SelfManagedCerts, error) {
+	cs, err := restClient()
+	if err != nil {
+		return nil, err
+	}
+	return newSelfManagedCerts(cs, cfg), nil
+}
+
+func newSelfManagedCerts(cs kubernetes.Interface, cfg SelfManagedCertsConfig) *SelfManagedCerts {
+	return &SelfManagedCerts{cs: cs, cfg: cfg}
+}
+
+// Run watches the certificate Secret and takes part in the leader election, until the context is done
+func (smc *SelfManagedCerts) Run(ctx context.Context) error {
+	if err := smc.watchSecret(ctx); err != nil {
+		return err
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: smc.cfg.Namespace, Name: smc.cfg.Secret},
+			Client:     smc.cs.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: smc.cfg.Identity},
+		},
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: smc.lead,
+			OnStoppedLeading: func() {
+				log.Infof("Stopped managing the webhook certificates")
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't create leader election: %w", err)
+	}
+	go func() {
+		// a replica losing the lease competes for it again
+		for ctx.Err() == nil {
+			le.Run(ctx)
+		}
+	}()
+	return nil
+}
+
+// watchSecret serves the certificate of the Secret and reloads it on changes
+func (smc *SelfManagedCerts) watchSecret(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(smc.cs, 0,
+		informers.WithNamespace(smc.cfg.Namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", smc.cfg.Secret).String()
+		}),
+	)
+	inf := factory.Core().V1().Secrets().Informer()
+	_, err := inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    smc.load,
+		UpdateFunc: func(_, obj any) { smc.load(obj) },
+	})
+	if err != nil {
+		return fmt.Errorf("could not add secret event handler: %w", err)
+	}
+	factory.Start(ctx.Done())
+	return nil
+}
+
+// load serves the certificate of the Secret, the current certificate is kept if it's invalid
+func (smc *SelfManagedCerts) load(obj any) {
+	s, ok := obj.(*corev1.Secret)
+	if !ok || s.Name != smc.cfg.Secret {
+		return
+	}
+	cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		log.Warnf("Can't load certificate of secret %s/%s, keeping the current one: %v", s.Namespace, s.Name, err)
+		return
+	}
+	if err := smc.set(&cert, "of secret "+s.Namespace+"/"+s.Name); err != nil {
+		log.Warnf("Can't load certificate, keeping the current one: %v", err)
+	}
+}
+
+// lead rotates the certificates while the replica holds the lease
+func (smc *SelfManagedCerts) lead(ctx context.Context) {
+	log.Infof("Managing the webhook certificates in secret %s/%s", smc.cfg.Namespace, smc.cfg.Secret)
+	t := time.NewTicker(certCheckInterval)
+	defer t.Stop()
+	for {
+		if err := smc.reconcile(ctx); err != nil {
+			log.Errorf("Can't reconcile webhook certificates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reconcile issues a new serving certificate if it's missing or due for rotation, and rotates the CA
+// if it's missing or due. The CA bundle is injected into the webhook configurations.
+func (smc *SelfManagedCerts) reconcile(ctx context.Context) error {
+	secrets := smc.cs.CoreV1().Secrets(smc.cfg.Namespace)
+	s, err := secrets.Get(ctx, smc.cfg.Secret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		s = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: smc.cfg.Namespace, Name: smc.cfg.Secret},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return fmt.Errorf("can't get secret %s/%s: %w", smc.cfg.Namespace, smc.cfg.Secret, err)
+	}
+
+	injected := func(ca *x509.Certificate) bool { return smc.caInjected(ctx, ca) }
+	changed, err := smc.rotate(s, time.Now(), injected)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if s.ResourceVersion == "" {
+			_, err = secrets.Create(ctx, s, metav1.CreateOptions{})
+		} else {
+			_, err = secrets.Update(ctx, s, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("can't store certificates in secret %s/%s: %w", smc.cfg.Namespace, smc.cfg.Secret, err)
+		}
+		log.Infof("Stored new webhook certificates in secret %s/%s", smc.cfg.Namespace, smc.cfg.Secret)
+	}
+	return smc.injectCABundle(ctx, s.Data[caCertKey])
+}
+
+// certDue reports whether the serving certificate of the Secret is missing, invalid, not signed by the CA
+// or less than a third of its validity remains
+func (smc *SelfManagedCerts) certDue(s *corev1.Secret, now time.Time) bool {
+	cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return true
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(s.Data[caCertKey]) {
+		return true
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: now}); err != nil {
+		return true
+	}
+	return due(cert.Leaf, now)
+}
+
+// due reports whether less than a third of the validity of the certificate remains
+func due(cert *x509.Certificate, now time.Time) bool {
+	return cert.NotAfter.Sub(now) < cert.NotAfter.Sub(cert.NotBefore)/3
+}
+
+// rotate rotates the certificates of the Secret which are due, it reports whether they changed. A due CA is
+// rotated in two steps: the new CA is added to the bundle first, while the serving certificate is still issued
+// by the current CA. Once injected reports the new CA is trusted by the webhook configurations, it issues the
+// serving certificate. The previous CA stays in the bundle until it expires, so certificates it signed are still trusted.
+func (smc *SelfManagedCerts) rotate(s *corev1.Secret, now time.Time, injected func(*x509.Certificate) bool) (bool, error) {
+	if s.Data == nil {
+		s.Data = map[string][]byte{}
+	}
+	ca, caKey, err := parseCA(s.Data[caCertKey], s.Data[caKeyKey])
+	if err != nil || !now.Before(ca.NotAfter) {
+		// without a valid CA, no trusted certificate is served which could be kept
+		ca, caKey, err = newCA(now, caValidityFactor*smc.cfg.Validity)
+		if err != nil {
+			return false, err
+		}
+		delete(s.Data, nextCACertKey)
+		delete(s.Data, nextCAKeyKey)
+		return true, smc.issue(s, ca, caKey, caBundle(nil, now, ca), now)
+	}
+
+	changed := false
+	if next, nextKey, err := parseCA(s.Data[nextCACertKey], s.Data[nextCAKeyKey]); err == nil {
+		if injected(next) {
+			log.Infof("Issuing webhook certificates with the new CA, valid until %s", next.NotAfter.Format(time.RFC3339))
+			delete(s.Data, nextCACertKey)
+			delete(s.Data, nextCAKeyKey)
+			return true, smc.issue(s, next, nextKey, caBundle(s.Data[caCertKey], now, next), now)
+		}
+		log.Infof("Waiting for the new webhook CA to be injected into the webhook configurations")
+	} else if due(ca, now) {
+		log.Infof("Rotating webhook CA, valid until %s", ca.NotAfter.Format(time.RFC3339))
+		next, nextKey, err := newCA(now, caValidityFactor*smc.cfg.Validity)
+		if err != nil {
+			return false, err
+		}
+		nextKeyDER, err := x509.MarshalECPrivateKey(nextKey)
+		if err != nil {
+			return false, fmt.Errorf("can't encode CA key: %w", err)
+		}
+		s.Data[nextCACertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: next.Raw})
+		s.Data[nextCAKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: nextKeyDER})
+		s.Data[caCertKey] = caBundle(s.Data[caCertKey], now, ca, next)
+		changed = true
+	}
+	if smc.certDue(s, now) {
+		return true, smc.issue(s, ca, caKey, s.Data[caCertKey], now)
+	}
+	return changed, nil
+}
+
+// issue issues a new serving certificate signed by the CA into the Secret, along with the CA bundle and key
+func (smc *SelfManagedCerts) issue(s *corev1.Secret, ca *x509.Certificate, caKey *ecdsa.PrivateKey, bundle []byte, now time.Time) error {
+	certPEM, keyPEM, err := newServingCert(ca, caKey, smc.dnsNames(), now, smc.cfg.Validity)
+	if err != nil {
+		return err
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return fmt.Errorf("can't encode CA key: %w", err)
+	}
+	s.Data[corev1.TLSCertKey] = certPEM
+	s.Data[corev1.TLSPrivateKeyKey] = keyPEM
+	s.Data[caCertKey] = bundle
+	s.Data[caKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER})
+	return nil
+}
+
+// caBundle returns the PEM bundle of the CAs, followed by the unexpired certificates of the previous bundle
+func caBundle(previous []byte, now time.Time, cas ...*x509.Certificate) []byte {
+	var bundle []byte
+	for _, ca := range cas {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	}
+	for _, c := range parseCertificates(previous) {
+		if !slices.ContainsFunc(cas, c.Equal) && now.Before(c.NotAfter) {
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+	}
+	return bundle
+}
+
+// dnsNames are the names the API server may use to reach the Service of the webhook
+func (smc *SelfManagedCerts) dnsNames() []string {
+	svc, ns := smc.cfg.Service, smc.cfg.Namespace
+	return []string{svc, svc + "." + ns, svc + "." + ns + ".svc", svc + "." + ns + ".svc.cluster.local"}
+}
+
+// injectCABundle sets the CA bundle on all webhooks of the webhook configurations.
+// A missing MutatingWebhookConfiguration is ignored, it's only installed if digest pinning is enabled.
+func (smc *SelfManagedCerts) injectCABundle(ctx context.Context, caBundle []byte) error {
+	webhooks := smc.cs.AdmissionregistrationV1()
+	vwc, err := webhooks.ValidatingWebhookConfigurations().Get(ctx, smc.cfg.WebhookConfig, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("can't get ValidatingWebhookConfiguration %s: %w", smc.cfg.WebhookConfig, err)
+	}
+	changed := false
+	for i := range vwc.Webhooks {
+		if !bytes.Equal(vwc.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			vwc.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if changed {
+		if _, err := webhooks.ValidatingWebhookConfigurations().Update(ctx, vwc, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("can't inject CA bundle into ValidatingWebhookConfiguration %s: %w", vwc.Name, err)
+		}
+		log.Infof("Injected CA bundle into ValidatingWebhookConfiguration %s", vwc.Name)
+	}
+
+	mwc, err := webhooks.MutatingWebhookConfigurations().Get(ctx, smc.cfg.WebhookConfig, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't get MutatingWebhookConfiguration %s: %w", smc.cfg.WebhookConfig, err)
+	}
+	changed = false
+	for i := range mwc.Webhooks {
+		if !bytes.Equal(mwc.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			mwc.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if changed {
+		if _, err := webhooks.MutatingWebhookConfigurations().Update(ctx, mwc, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("can't inject CA bundle into MutatingWebhookConfiguration %s: %w", mwc.Name, err)
+		}
+		log.Infof("Injected CA bundle into MutatingWebhookConfiguration %s", mwc.Name)
+	}
+	return nil
+}
+
+// caInjected reports whether the CA is in the CA bundle of all webhooks of the webhook configurations
+func (smc *SelfManagedCerts) caInjected(ctx context.Context, ca *x509.Certificate) bool {
+	webhooks := smc.cs.AdmissionregistrationV1()
+	vwc, err := webhooks.ValidatingWebhookConfigurations().Get(ctx, smc.cfg.WebhookConfig, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("Can't get ValidatingWebhookConfiguration %s: %v", smc.cfg.WebhookConfig, err)
+		return false
+	}
+	for i := range vwc.Webhooks {
+		if !slices.ContainsFunc(parseCertificates(vwc.Webhooks[i].ClientConfig.CABundle), ca.Equal) {
+			return false
+		}
+	}
+	mwc, err := webhooks.MutatingWebhookConfigurations().Get(ctx, smc.cfg.WebhookConfig, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		log.Warnf("Can't get MutatingWebhookConfiguration %s: %v", smc.cfg.WebhookConfig, err)
+		return false
+	}
+	for i := range mwc.Webhooks {
+		if !slices.ContainsFunc(parseCertificates(mwc.Webhooks[i].ClientConfig.CABundle), ca.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCA returns the first certificate of the bundle and the CA key
+func parseCA(bundle, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certs := parseCertificates(bundle)
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no CA certificate")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA key: %w", err)
+	}
+	return certs[0], key, nil
+}
+
+// parseCertificates returns the certificates of the PEM bundle, invalid blocks are skipped
+func parseCertificates(bundle []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, c)
+		}
+	}
+}
+
+// newCA creates a self-signed CA
+func newCA(now time.Time, validity time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't generate CA key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't generate serial number: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "cosignwebhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't create CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse CA certificate: %w", err)
+	}
+	return ca, key, nil
+}
+
+// newServingCert issues a serving certificate for the DNS names, signed by the CA.
+// It returns the PEM encoded certificate and key.
+func newServingCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string, now time.Time, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't generate serial number: %w", err)
+	}
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't encode key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
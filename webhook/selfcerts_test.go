@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSelfManagedCerts_reconcile(t *testing.T) {
+	vwc := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosignwebhook"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "webhook.example.com"}},
+	}
+	mwc := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cosignwebhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mutate.webhook.example.com"}},
+	}
+	cs := fake.NewSimpleClientset(vwc, mwc)
+	smc := newSelfManagedCerts(cs, SelfManagedCertsConfig{
+		Namespace:     "cosignwebhook",
+		Service:       "cosignwebhook",
+		Secret:        "cosignwebhook",
+		WebhookConfig: "cosignwebhook",
+		Validity:      24 * time.Hour,
+	})
+
+	if err := smc.reconcile(t.Context()); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	s, err := cs.CoreV1().Secrets("cosignwebhook").Get(t.Context(), "cosignwebhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected certificate secret: %v", err)
+	}
+
+	// the serving certificate is trusted by the injected CA bundle for the service name
+	caBundle := s.Data[caCertKey]
+	cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		t.Fatalf("invalid serving certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caBundle)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "cosignwebhook.cosignwebhook.svc"}); err != nil {
+		t.Errorf("serving certificate not trusted by CA bundle: %v", err)
+	}
+	gotVWC, _ := cs.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(t.Context(), "cosignwebhook", metav1.GetOptions{})
+	if !bytes.Equal(gotVWC.Webhooks[0].ClientConfig.CABundle, caBundle) {
+		t.Error("expected CA bundle injected into ValidatingWebhookConfiguration")
+	}
+	gotMWC, _ := cs.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(t.Context(), "cosignwebhook", metav1.GetOptions{})
+	if !bytes.Equal(gotMWC.Webhooks[0].ClientConfig.CABundle, caBundle) {
+		t.Error("expected CA bundle injected into MutatingWebhookConfiguration")
+	}
+
+	// the CA is confirmed to be injected before it issues certificates
+	if !smc.caInjected(t.Context(), parseCertificates(caBundle)[0]) {
+		t.Error("expected injected CA to be confirmed")
+	}
+	other, _, err := newCA(time.Now(), time.Hour)
+	if err != nil {
+		t.Fatalf("newCA() error = %v", err)
+	}
+	if smc.caInjected(t.Context(), other) {
+		t.Error("expected CA missing in the webhook configurations not to be confirmed")
+	}
+
+	// a valid certificate isn't rotated
+	if err := smc.reconcile(t.Context()); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	again, _ := cs.CoreV1().Secrets("cosignwebhook").Get(t.Context(), "cosignwebhook", metav1.GetOptions{})
+	if !bytes.Equal(again.Data[corev1.TLSCertKey], s.Data[corev1.TLSCertKey]) {
+		t.Error("expected valid certificate to be kept")
+	}
+
+	// all replicas serve the certificate of the secret
+	if err := smc.Ready(); err == nil {
+		t.Error("expected not to be ready before the secret is loaded")
+	}
+	smc.load(s)
+	if err := smc.Ready(); err != nil {
+		t.Errorf("Ready() error = %v", err)
+	}
+}
+
+func TestSelfManagedCerts_rotate(t *testing.T) {
+	smc := newSelfManagedCerts(fake.NewSimpleClientset(), SelfManagedCertsConfig{
+		Namespace: "cosignwebhook",
+		Service:   "cosignwebhook",
+		Validity:  24 * time.Hour,
+	})
+	injected := false
+	rotate := func(s *corev1.Secret, now time.Time) bool {
+		t.Helper()
+		changed, err := smc.rotate(s, now, func(*x509.Certificate) bool { return injected })
+		if err != nil {
+			t.Fatalf("rotate() error = %v", err)
+		}
+		return changed
+	}
+	// issuedBy reports whether the serving certificate is signed by the CA
+	issuedBy := func(s *corev1.Secret, ca *x509.Certificate, now time.Time) bool {
+		t.Helper()
+		cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			t.Fatalf("invalid serving certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: now})
+		return err == nil
+	}
+
+	now := time.Now()
+	s := &corev1.Secret{}
+	if !smc.certDue(s, now) {
+		t.Fatal("expected missing certificate to be due")
+	}
+	if !rotate(s, now) {
+		t.Fatal("expected missing certificate to be issued")
+	}
+	if smc.certDue(s, now) {
+		t.Error("expected new certificate not to be due")
+	}
+	if rotate(s, now) {
+		t.Error("expected valid certificate to be kept")
+	}
+	if !smc.certDue(s, now.Add(20*time.Hour)) {
+		t.Error("expected certificate to be due with less than a third of its validity left")
+	}
+	ca := parseCertificates(s.Data[caCertKey])
+
+	// the serving certificate is rotated with the same CA
+	if !rotate(s, now.Add(20*time.Hour)) {
+		t.Fatal("expected due certificate to be rotated")
+	}
+	if got := parseCertificates(s.Data[caCertKey]); len(got) != 1 || !got[0].Equal(ca[0]) {
+		t.Errorf("expected CA to be kept, got %d CAs", len(got))
+	}
+
+	// once the CA is due, the new CA is added to the bundle, but the serving certificate is
+	// still issued by the previous CA until the bundle is injected
+	later := now.Add(8 * 24 * time.Hour)
+	if !rotate(s, later) {
+		t.Fatal("expected due CA to be rotated")
+	}
+	got := parseCertificates(s.Data[caCertKey])
+	next := parseCertificates(s.Data[nextCACertKey])
+	if len(got) != 2 || !got[0].Equal(ca[0]) || len(next) != 1 || !got[1].Equal(next[0]) {
+		t.Fatalf("expected previous CA followed by the new one, got %d CAs", len(got))
+	}
+	if !issuedBy(s, ca[0], later) {
+		t.Error("expected serving certificate of the previous CA until the new one is injected")
+	}
+	if rotate(s, later) {
+		t.Error("expected new CA not to issue certificates before it's injected")
+	}
+
+	injected = true
+	if !rotate(s, later) {
+		t.Fatal("expected injected CA to issue the serving certificate")
+	}
+	got = parseCertificates(s.Data[caCertKey])
+	if len(got) != 2 || !got[0].Equal(next[0]) || !got[1].Equal(ca[0]) {
+		t.Fatalf("expected new CA followed by the previous one, got %d CAs", len(got))
+	}
+	if !issuedBy(s, next[0], later) || s.Data[nextCACertKey] != nil || s.Data[nextCAKeyKey] != nil {
+		t.Error("expected serving certificate of the new CA")
+	}
+	if smc.certDue(s, later) {
+		t.Error("expected certificate of the new CA not to be due")
+	}
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/eumel8/cosignwebhook/api/v1alpha1"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CosignThresholdEnvVar is the number of public keys the signatures of the container must be verified by
+const CosignThresholdEnvVar = "COSIGN_KEY_THRESHOLD"
+
+// thresholdAll requires the signatures to be verified by all authorities
+const thresholdAll = -1
+
+// parseThreshold parses the number of authorities required to verify the signatures:
+// "any" (the default), "all" or a positive number.
+func parseThreshold(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "any":
+		return 1, nil
+	case "all":
+		return thresholdAll, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid threshold %q, must be any, all or a positive number", s)
+	}
+	return n, nil
+}
+
+// withThreshold removes duplicate authorities, so each party is only counted once,
+// and sets the number of the remaining authorities required to verify the signatures.
+// Keys are compared by the parsed key, KMS keys and overlapping identities are counted once on verification.
+func withThreshold(auths []*authority, threshold int) ([]*authority, error) {
+	seen := map[string]bool{}
+	unique := make([]*authority, 0, len(auths))
+	for _, a := range auths {
+		if fp := a.fingerprint(); !seen[fp] {
+			seen[fp] = true
+			unique = append(unique, a)
+		}
+	}
+	if threshold == thresholdAll {
+		threshold = len(unique)
+	}
+	if threshold > len(unique) {
+		return nil, fmt.Errorf("threshold %d exceeds the %d distinct authorities", threshold, len(unique))
+	}
+	for _, a := range unique {
+		a.threshold = threshold
+	}
+	return unique, nil
+}
+
+// signersOf returns the parties whose signatures verified the authority: the public key, or the certificate
+// identities of keyless signatures. It falls back to the authority if the signers are unknown.
+func (r *verificationResult) signersOf(auth *authority) []string {
+	switch {
+	case r.keyFingerprint != "":
+		return []string{r.keyFingerprint}
+	case len(r.signers) > 0:
+		return r.signers
+	}
+	return []string{auth.fingerprint()}
+}
+
+// distinctSigners returns the number of authorities which can each be credited to a different signer,
+// so the same key given twice, or a certificate matching overlapping identities, is only counted once.
+// The signers of each authority are matched with augmenting paths, the result is the maximum matching.
+func distinctSigners(signers [][]string) int {
+	owner := map[string]int{}
+	var match func(i int, visited map[string]bool) bool
+	match = func(i int, visited map[string]bool) bool {
+		for _, s := range signers[i] {
+			if visited[s] {
+				continue
+			}
+			visited[s] = true
+			if j, ok := owner[s]; !ok || match(j, visited) {
+				owner[s] = i
+				return true
+			}
+		}
+		return false
+	}
+	n := 0
+	for i := range signers {
+		if match(i, map[string]bool{}) {
+			n++
+		}
+	}
+	return n
+}
+
+// keyFingerprint returns the SHA-256 fingerprint of the DER encoded public key of the verifier,
+// or an empty string for keyless verification
+func keyFingerprint(v signature.Verifier) string {
+	if v == nil {
+		return ""
+	}
+	pub, err := v.PublicKey()
+	if err != nil {
+		return ""
+	}
+	return publicKeyFingerprint(pub)
+}
+
+// pemKeyFingerprint returns the fingerprint of the PEM encoded public key, or an empty string
+// if it isn't a public key, e.g. a KMS key reference
+func pemKeyFingerprint(pubKey string) string {
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(pubKey))
+	if err != nil {
+		return ""
+	}
+	return publicKeyFingerprint(pub)
+}
+
+// publicKeyFingerprint returns the SHA-256 fingerprint of the DER encoded public key
+func publicKeyFingerprint(pub crypto.PublicKey) string {
+	der, err := cryptoutils.MarshalPublicKeyToDER(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// authorityGroup holds the authorities of a policy, or of the container
+type authorityGroup struct {
+	policy string
+	// namespaced is set for the group of an ImagePolicy
+	namespaced   bool
+	threshold    int
+	auths        []*authority
+	attestations []v1alpha1.Attestation
+	evaluation   *v1alpha1.Policy
+}
+
+// groupAuthorities groups the authorities by their policy, keeping their order
+func groupAuthorities(auths []*authority) []*authorityGroup {
+	var groups []*authorityGroup
+	byPolicy := map[string]*authorityGroup{}
+	for _, a := range auths {
+		g, ok := byPolicy[a.policy]
+		if !ok {
+			g = &authorityGroup{
+				policy:       a.policy,
+				namespaced:   a.namespaced,
+				threshold:    max(a.threshold, 1),
+				attestations: a.attestations,
+				evaluation:   a.evaluation,
+			}
+			byPolicy[a.policy] = g
+			groups = append(groups, g)
+		}
+		g.auths = append(g.auths, a)
+	}
+	return groups
+}
+
+// wrap prefixes the error with the policy of the group, if any
+func (g *authorityGroup) wrap(err error) error {
+	if g.policy == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", g.policy, err)
+}
+
+// getThresholdFor returns the threshold of the container's public keys.
+// It's read from the container's environment or the default secret of the namespace, and defaults to any.
+func (csh *CosignServerHandler) getThresholdFor(c *corev1.Container, ns string) (int, error) {
+	return parseThreshold(csh.getSettingFor(c, ns, CosignThresholdEnvVar))
+}
+
+// splitPublicKeys splits concatenated PEM blocks into single public keys.
+// Values without a PEM block are returned as is, so they're reported as malformed on verification.
+func splitPublicKeys(pubKeys string) []string {
+	var keys []string
+	rest := []byte(pubKeys)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		keys = append(keys, string(pem.EncodeToMemory(block)))
+	}
+	if len(keys) == 0 {
+		return []string{pubKeys}
+	}
+	return keys
+}
@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	ocimutate "github.com/sigstore/cosign/v3/pkg/oci/mutate"
+	ociremote "github.com/sigstore/cosign/v3/pkg/oci/remote"
+	"github.com/sigstore/cosign/v3/pkg/oci/static"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseThreshold(t *testing.T) {
+	tests := []struct {
+		threshold string
+		want      int
+		wantErr   bool
+	}{
+		{threshold: "", want: 1},
+		{threshold: "any", want: 1},
+		{threshold: "All", want: thresholdAll},
+		{threshold: "2", want: 2},
+		{threshold: "0", wantErr: true},
+		{threshold: "-1", wantErr: true},
+		{threshold: "most", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.threshold, func(t *testing.T) {
+			got, err := parseThreshold(tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseThreshold() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseThreshold() got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_withThreshold(t *testing.T) {
+	auths := func() []*authority {
+		return []*authority{{pubKey: "old key"}, {pubKey: "new key"}, {pubKey: "new key"}}
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		want      int
+		wantErr   bool
+	}{
+		{name: "any", threshold: 1, want: 1},
+		{name: "all distinct", threshold: thresholdAll, want: 2},
+		{name: "two of two", threshold: 2, want: 2},
+		{name: "duplicates don't count", threshold: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withThreshold(auths(), tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withThreshold() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != 2 {
+				t.Fatalf("expected duplicate key to be removed, got %d authorities", len(got))
+			}
+			for _, a := range got {
+				if a.threshold != tt.want {
+					t.Errorf("withThreshold() got threshold %d, want %d", a.threshold, tt.want)
+				}
+			}
+		})
+	}
+
+	// the same key encoded differently is counted once
+	pubKey := string(testPubKeyPEM(t, testECDSAPubKey(t)))
+	reencoded := strings.Replace(pubKey, "-----\n", "-----\nComment: release key\n\n", 1)
+	if _, err := withThreshold([]*authority{{pubKey: pubKey}, {pubKey: reencoded}}, 2); err == nil {
+		t.Error("expected the same key to be counted once")
+	}
+}
+
+func Test_splitPublicKeys(t *testing.T) {
+	first := string(testPubKeyPEM(t, testECDSAPubKey(t)))
+	second := string(testPubKeyPEM(t, testRSAPubKey(t)))
+
+	if got := splitPublicKeys(first); len(got) != 1 || got[0] != first {
+		t.Errorf("expected single key, got %v", got)
+	}
+	if got := splitPublicKeys(first + "\n" + second); len(got) != 2 || got[0] != first || got[1] != second {
+		t.Errorf("expected both keys, got %v", got)
+	}
+	if got := splitPublicKeys("i'm not a key!"); len(got) != 1 || got[0] != "i'm not a key!" {
+		t.Errorf("expected malformed key to be returned as is, got %v", got)
+	}
+}
+
+func TestCosignServerHandler_getThresholdFor(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cosignwebhook",
+			Namespace: "test",
+		},
+		Data: map[string][]byte{
+			CosignThresholdEnvVar: []byte("all"),
+		},
+	})
+	csh := &CosignServerHandler{cs: c}
+
+	tests := []struct {
+		name    string
+		ns      string
+		env     []corev1.EnvVar
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "threshold from env",
+			ns:   "test",
+			env:  []corev1.EnvVar{{Name: CosignThresholdEnvVar, Value: "2"}},
+			want: 2,
+		},
+		{
+			name: "threshold from default secret",
+			ns:   "test",
+			want: thresholdAll,
+		},
+		{
+			name: "default threshold",
+			ns:   "other",
+			want: 1,
+		},
+		{
+			name:    "invalid threshold",
+			ns:      "other",
+			env:     []corev1.EnvVar{{Name: CosignThresholdEnvVar, Value: "none"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := csh.getThresholdFor(&corev1.Container{Name: "test", Env: tt.env}, tt.ns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getThresholdFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getThresholdFor() got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_distinctSigners(t *testing.T) {
+	tests := []struct {
+		name    string
+		signers [][]string
+		want    int
+	}{
+		{name: "none", want: 0},
+		{name: "different keys", signers: [][]string{{"a"}, {"b"}}, want: 2},
+		{name: "same key twice", signers: [][]string{{"a"}, {"a"}}, want: 1},
+		{name: "overlapping identities", signers: [][]string{{"a", "b"}, {"a"}}, want: 2},
+		{name: "single certificate for overlapping identities", signers: [][]string{{"a"}, {"a"}, {"a", "b"}}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := distinctSigners(tt.signers); got != tt.want {
+				t.Errorf("distinctSigners() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCosignServerHandler_verifyContainer_sameKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating ECDSA key: %v", err)
+	}
+	pubKey := string(testPubKeyPEM(t, &key.PublicKey))
+	digest := testSignedImage(t, key)
+
+	// the KMS key refers to the inline key
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"latest_version": 1,
+				"keys":           map[string]any{"1": map[string]any{"name": "P-256", "public_key": pubKey}},
+			},
+		})
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "test")
+
+	csh := &CosignServerHandler{}
+	c := corev1.Container{Name: "app", Image: digest.String()}
+	auths := []*authority{{pubKey: pubKey, threshold: 2}, {pubKey: "hashivault://cosign", threshold: 2}}
+	_, err = csh.verifyContainer(t.Context(), c, auths, authn.NewMultiKeychain(), nil)
+	if err == nil || !strings.Contains(err.Error(), "verified by 1 of 2 required distinct signers") {
+		t.Fatalf("expected the same key to be counted once, got %v", err)
+	}
+
+	for _, a := range auths {
+		a.threshold = 1
+	}
+	if _, err := csh.verifyContainer(t.Context(), c, auths, authn.NewMultiKeychain(), nil); err != nil {
+		t.Errorf("verifyContainer() error = %v", err)
+	}
+}
+
+// testSignedImage pushes a random image to an in-memory registry and signs it with the key
+// in the legacy signature format. It returns the digest of the image.
+func testSignedImage(t testing.TB, key *ecdsa.PrivateKey) name.Digest {
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("failed creating image: %v", err)
+	}
+	ref, err := name.ParseReference(strings.TrimPrefix(s.URL, "http://") + "/app:1.0")
+	if err != nil {
+		t.Fatalf("failed parsing reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("failed pushing image: %v", err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatalf("failed getting digest: %v", err)
+	}
+	digest := ref.Context().Digest(h.String())
+
+	p, err := payload.Cosign{Image: digest}.MarshalJSON()
+	if err != nil {
+		t.Fatalf("failed creating payload: %v", err)
+	}
+	signer, err := signature.LoadECDSASigner(key, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed loading signer: %v", err)
+	}
+	sig, err := signer.SignMessage(bytes.NewReader(p))
+	if err != nil {
+		t.Fatalf("failed signing payload: %v", err)
+	}
+	ociSig, err := static.NewSignature(p, base64.StdEncoding.EncodeToString(sig))
+	if err != nil {
+		t.Fatalf("failed creating signature: %v", err)
+	}
+	se, err := ociremote.SignedEntity(digest)
+	if err != nil {
+		t.Fatalf("failed getting signed entity: %v", err)
+	}
+	se, err = ocimutate.AttachSignatureToEntity(se, ociSig)
+	if err != nil {
+		t.Fatalf("failed attaching signature: %v", err)
+	}
+	if err := ociremote.WriteSignatures(digest.Repository, se); err != nil {
+		t.Fatalf("failed pushing signature: %v", err)
+	}
+	return digest
+}
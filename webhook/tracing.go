@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/eumel8/cosignwebhook/webhook"
+
+// spans of the stages of an admission
+const (
+	spanAdmission       = "admission"
+	spanKeychain        = "keychain"
+	spanAuthorities     = "authorities"
+	spanVerifyContainer = "verifyContainer"
+	spanResolveDigest   = "resolveDigest"
+	spanVerifyAuthority = "verifyAuthority"
+	spanGetBundles      = "getBundles"
+	spanVerifyBundle    = "verifyBundle"
+	spanVerifyLegacy    = "verifyLegacy"
+	spanAttestations    = "attestations"
+	spanEvaluate        = "evaluate"
+)
+
+// tracePropagator reads the trace context of the admission requests
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// NewTracerProvider creates a tracer provider exporting the spans to the OTLP/HTTP collector at the endpoint,
+// e.g. http://otel-collector:4318. The path defaults to /v1/traces, sampleRatio is the ratio of sampled
+// admissions whose trace isn't sampled by the API server already. The provider must be shut down to flush the spans.
+func NewTracerProvider(ctx context.Context, endpoint string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q, expected e.g. http://otel-collector:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+	// the service name may be overridden with OTEL_SERVICE_NAME
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cosignwebhook")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	), nil
+}
+
+// newRegistryTransport creates the transport of the registry requests, recording their duration and spans.
+// The trace context isn't propagated, the registries are usually third parties.
+func newRegistryTransport(next http.RoundTripper, registries *labelLimiter, tp trace.TracerProvider) http.RoundTripper {
+	return otelhttp.NewTransport(&registryTransport{next: next, registries: registries},
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+	)
+}
+
+// startSpan starts a span of a stage, spans aren't recorded if the handler has no tracer
+func (csh *CosignServerHandler) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := otel.Tracer(tracerName)
+	if csh != nil && csh.tracer != nil {
+		tracer = csh.tracer
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording the error if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	if _, err := NewTracerProvider(t.Context(), "otel-collector:4318", 1); err == nil {
+		t.Error("expected endpoint without scheme to be rejected")
+	}
+
+	tp, err := NewTracerProvider(t.Context(), collector.URL, 1)
+	if err != nil {
+		t.Fatalf("NewTracerProvider() error = %v", err)
+	}
+	_, span := tp.Tracer(tracerName).Start(t.Context(), spanAdmission)
+	span.End()
+	// the spans are flushed on shutdown
+	if err := tp.Shutdown(t.Context()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "POST /v1/traces application/x-protobuf" {
+		t.Errorf("expected spans to be exported to /v1/traces, got %v", paths)
+	}
+}
+
+func TestCosignServerHandler_verifyContainer_tracing(t *testing.T) {
+	var mu sync.Mutex
+	var headers []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = append(headers, r.Header.Get("traceparent")+r.Header.Get("baggage"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer registry.Close()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	csh := &CosignServerHandler{
+		tracer:    tp.Tracer(tracerName),
+		transport: newRegistryTransport(http.DefaultTransport, nil, tp),
+	}
+	c := corev1.Container{Name: "app", Image: strings.TrimPrefix(registry.URL, "http://") + "/app:1.0"}
+	if _, err := csh.verifyContainer(t.Context(), c, nil, authn.NewMultiKeychain(), nil); failureReason(err) != reasonRegistry {
+		t.Fatalf("expected registry error, got %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	container, ok := spans[spanVerifyContainer]
+	if !ok {
+		t.Fatalf("expected %s span, got %v", spanVerifyContainer, spans)
+	}
+	if container.Status().Code != codes.Error {
+		t.Errorf("expected failed container span to have error status, got %v", container.Status())
+	}
+	digest, ok := spans[spanResolveDigest]
+	if !ok || digest.Parent().SpanID() != container.SpanContext().SpanID() {
+		t.Errorf("expected %s span to be a child of the container span", spanResolveDigest)
+	}
+
+	// the registry requests are recorded, but the trace context isn't sent to the registries
+	var requests int
+	for _, s := range sr.Ended() {
+		if s.SpanKind() == trace.SpanKindClient && s.Parent().TraceID() == container.SpanContext().TraceID() {
+			requests++
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(headers) == 0 || requests < len(headers) {
+		t.Fatalf("expected a span per registry request, got %d spans for %d requests", requests, len(headers))
+	}
+	for _, h := range headers {
+		if h != "" {
+			t.Errorf("expected no trace context in the registry requests, got %q", h)
+		}
+	}
+}
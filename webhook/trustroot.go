@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sigstore/cosign/v3/pkg/cosign"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+// loadTrustedRoot reads the Fulcio certificate chain and the Rekor public key from the passed files
+// and builds the trusted material used for keyless and transparency log verification.
+// Empty file names are skipped.
+func loadTrustedRoot(fulcioRootFile, rekorPubKeyFile string) (root.TrustedMaterial, error) {
+	var fulcioPEM, rekorPEM []byte
+	var err error
+	if fulcioRootFile != "" {
+		fulcioPEM, err = os.ReadFile(fulcioRootFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read fulcio root %q: %w", fulcioRootFile, err)
+		}
+	}
+	if rekorPubKeyFile != "" {
+		rekorPEM, err = os.ReadFile(rekorPubKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read rekor public key %q: %w", rekorPubKeyFile, err)
+		}
+	}
+	return newTrustedRoot(fulcioPEM, rekorPEM)
+}
+
+// newTrustedRoot builds the trusted material from a PEM encoded Fulcio certificate chain
+// and a PEM encoded Rekor public key. Either of them may be empty.
+func newTrustedRoot(fulcioPEM, rekorPEM []byte) (root.TrustedMaterial, error) {
+	var cas []root.CertificateAuthority
+	if len(fulcioPEM) > 0 {
+		ca, err := newFulcioCA(fulcioPEM)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+
+	tlogs := map[string]*root.TransparencyLog{}
+	if len(rekorPEM) > 0 {
+		tlog, err := newRekorLog(rekorPEM)
+		if err != nil {
+			return nil, err
+		}
+		tlogs[hex.EncodeToString(tlog.ID)] = tlog
+	}
+
+	tr, err := root.NewTrustedRoot(root.TrustedRootMediaType01, cas, nil, nil, tlogs)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trusted root: %w", err)
+	}
+	return tr, nil
+}
+
+// newFulcioCA creates the certificate authority from a PEM encoded Fulcio certificate chain.
+// The chain may contain intermediates, the self-signed certificate is used as root.
+func newFulcioCA(fulcioPEM []byte) (*root.FulcioCertificateAuthority, error) {
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM(fulcioPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse fulcio root: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in fulcio root")
+	}
+
+	ca := &root.FulcioCertificateAuthority{}
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			ca.Root = cert
+			continue
+		}
+		ca.Intermediates = append(ca.Intermediates, cert)
+	}
+	if ca.Root == nil {
+		return nil, fmt.Errorf("no self-signed root certificate found in fulcio root")
+	}
+	ca.ValidityPeriodStart = ca.Root.NotBefore
+	return ca, nil
+}
+
+// newRekorLog creates the transparency log from a PEM encoded Rekor public key.
+// Signed entry timestamps and inclusion proofs are verified offline against this key.
+func newRekorLog(rekorPEM []byte) (*root.TransparencyLog, error) {
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(rekorPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rekor public key: %w", err)
+	}
+	logID, err := cosign.GetTransparencyLogID(pub)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute rekor log id: %w", err)
+	}
+	id, err := hex.DecodeString(logID)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode rekor log id: %w", err)
+	}
+	return &root.TransparencyLog{
+		ID: id,
+		// the key is trusted for all entries, sigstore requires a start of the validity period
+		ValidityPeriodStart: time.Unix(0, 0),
+		HashFunc:            crypto.SHA256,
+		PublicKey:           pub,
+		SignatureHashFunc:   crypto.SHA256,
+	}, nil
+}
+
+// isSelfSigned reports whether the certificate is its own issuer
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
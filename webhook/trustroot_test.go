@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+func Test_newTrustedRoot(t *testing.T) {
+	rootCert, rootKey := testCACert(t, "root", nil, nil)
+	intermediate, _ := testCACert(t, "intermediate", rootCert, rootKey)
+	rekorKey := testPubKeyPEM(t, testECDSAPubKey(t))
+
+	tests := []struct {
+		name      string
+		fulcio    []byte
+		rekor     []byte
+		wantCAs   int
+		wantTlogs int
+		wantErr   bool
+	}{
+		{
+			name:    "root only",
+			fulcio:  testCertsPEM(t, rootCert),
+			wantCAs: 1,
+		},
+		{
+			name:    "chain with intermediate",
+			fulcio:  testCertsPEM(t, intermediate, rootCert),
+			wantCAs: 1,
+		},
+		{
+			name:      "rekor key only",
+			rekor:     rekorKey,
+			wantTlogs: 1,
+		},
+		{
+			name:      "fulcio root and rekor key",
+			fulcio:    testCertsPEM(t, rootCert),
+			rekor:     rekorKey,
+			wantCAs:   1,
+			wantTlogs: 1,
+		},
+		{
+			name:    "intermediate without root",
+			fulcio:  testCertsPEM(t, intermediate),
+			wantErr: true,
+		},
+		{
+			name:    "no certificates",
+			fulcio:  []byte("i'm not a certificate!"),
+			wantErr: true,
+		},
+		{
+			name:    "malformed rekor key",
+			rekor:   []byte("i'm not a key!"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTrustedRoot(tt.fulcio, tt.rekor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTrustedRoot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if n := len(got.FulcioCertificateAuthorities()); n != tt.wantCAs {
+				t.Errorf("expected %d certificate authorities, got %d", tt.wantCAs, n)
+			}
+			if n := len(got.RekorLogs()); n != tt.wantTlogs {
+				t.Errorf("expected %d transparency logs, got %d", tt.wantTlogs, n)
+			}
+		})
+	}
+}
+
+// testCACert creates a CA certificate, self-signed if no parent is passed
+func testCACert(t testing.TB, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating ECDSA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing certificate: %v", err)
+	}
+	return cert, key
+}
+
+// testCertsPEM encodes the certificates as PEM
+func testCertsPEM(t testing.TB, certs ...*x509.Certificate) []byte {
+	pem, err := cryptoutils.MarshalCertificatesToPEM(certs)
+	if err != nil {
+		t.Fatalf("failed encoding certificates: %v", err)
+	}
+	return pem
+}
+
+// testPubKeyPEM encodes the public key as PEM
+func testPubKeyPEM(t testing.TB, pub any) []byte {
+	pem, err := cryptoutils.MarshalPublicKeyToPEM(pub)
+	if err != nil {
+		t.Fatalf("failed encoding public key: %v", err)
+	}
+	return pem
+}